@@ -0,0 +1,205 @@
+package gdp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	modzip "golang.org/x/mod/zip"
+)
+
+// extractedFile is a regular file of a repository archive whose
+// contents were saved to disk, so that golang.org/x/mod/zip can
+// open files in any order and check their sizes up front.
+// It implements modzip.File.
+type extractedFile struct {
+	name string // slash separated, relative to the module root
+	path string // where the contents are on disk
+	info os.FileInfo
+}
+
+func (f *extractedFile) Path() string                 { return f.name }
+func (f *extractedFile) Lstat() (os.FileInfo, error)  { return f.info, nil }
+func (f *extractedFile) Open() (io.ReadCloser, error) { return os.Open(f.path) }
+
+// maxModuleSize is how much of a module extract saves, which is
+// the most that golang.org/x/mod/zip takes for the files of a zip.
+var maxModuleSize int64 = modzip.MaxZipFile
+
+// extracted is the module directory of a repository archive.
+type extracted struct {
+	tmp   string
+	files []modzip.File
+}
+
+func (e *extracted) close() {
+	os.RemoveAll(e.tmp)
+}
+
+// extract saves every regular file under moduleDir, a slash
+// terminated directory of the repository or empty for its root,
+// to a temporary directory and closes body. Files are saved under
+// numbered names, so archive paths never touch the file system.
+// Like cmd/go, a module in a subdirectory without a LICENSE of
+// its own gets the one at the root of the repository.
+func extract(body io.ReadCloser, format ArchiveFormat, moduleDir string) (*extracted, error) {
+	defer body.Close()
+	tmp, err := ioutil.TempDir("", "gdp-archive")
+	if err != nil {
+		return nil, errors.Wrap(err, "tempDir")
+	}
+	e := &extracted{tmp: tmp}
+	var license, rootLicense modzip.File
+	// size counts what was saved, to stop at the limit of a module
+	// zip rather than writing a huge repository to disk first.
+	var size int64
+	save := func(name string, r io.Reader) error {
+		isRootLicense := moduleDir != "" && name == "LICENSE"
+		if !strings.HasPrefix(name, moduleDir) && !isRootLicense {
+			return nil
+		}
+		p := filepath.Join(tmp, strconv.Itoa(len(e.files)))
+		if isRootLicense {
+			p = filepath.Join(tmp, "LICENSE")
+		}
+		f, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(f, io.LimitReader(r, maxModuleSize-size+1))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		if size += n; size > maxModuleSize {
+			return errors.Errorf("module source tree too large (max size is %v bytes)", maxModuleSize)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		ef := &extractedFile{strings.TrimPrefix(name, moduleDir), p, info}
+		switch {
+		case isRootLicense:
+			rootLicense = ef
+			return nil
+		case ef.name == "LICENSE":
+			license = ef
+		}
+		e.files = append(e.files, ef)
+		return nil
+	}
+
+	if format == ArchiveZip {
+		err = walkZip(body, tmp, save)
+	} else {
+		err = walkTarGz(body, save)
+	}
+	if err != nil {
+		e.close()
+		return nil, err
+	}
+	if license == nil && rootLicense != nil {
+		e.files = append(e.files, rootLicense)
+	}
+
+	return e, nil
+}
+
+// walkFunc is called for every regular file in an archive, with
+// its name relative to the archive's top level directory.
+type walkFunc func(name string, r io.Reader) error
+
+func walkTarGz(body io.Reader, fn walkFunc) error {
+	gr, err := gzip.NewReader(body)
+	if err != nil {
+		return errors.Wrap(err, "gzipNewReader")
+	}
+	t := tar.NewReader(gr)
+	var root string
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "tarNext")
+		}
+		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeDir {
+			continue
+		}
+		// Go expects the zip to have a certain directory prefix, so the
+		// archive's own top level directory is cut off every name. Github
+		// always has a directory header, while bitbucket jumps straight
+		// into the file. The first entry accounts for both cases.
+		if root == "" {
+			root = topDir(h.Name, h.Typeflag == tar.TypeDir)
+		}
+		if h.Typeflag != tar.TypeReg || !strings.HasPrefix(h.Name, root) {
+			continue
+		}
+		if err := fn(strings.TrimPrefix(h.Name, root), t); err != nil {
+			return err
+		}
+	}
+}
+
+// walkZip spools body to a file in tmp first since a zip
+// can't be read before its central directory at the end.
+func walkZip(body io.Reader, tmp string, fn walkFunc) error {
+	f, err := ioutil.TempFile(tmp, "archive")
+	if err != nil {
+		return errors.Wrap(err, "tempFile")
+	}
+	defer f.Close()
+	size, err := io.Copy(f, body)
+	if err != nil {
+		return errors.Wrap(err, "spool")
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return errors.Wrap(err, "zipNewReader")
+	}
+	var root string
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		if !mode.IsRegular() && !mode.IsDir() {
+			continue
+		}
+		if root == "" {
+			root = topDir(zf.Name, mode.IsDir())
+		}
+		if !mode.IsRegular() || !strings.HasPrefix(zf.Name, root) {
+			continue
+		}
+		rc, err := zf.Open()
+		if err != nil {
+			return errors.Wrap(err, "zipOpen")
+		}
+		err = fn(strings.TrimPrefix(zf.Name, root), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// topDir returns the top level directory of an archive,
+// with a trailing slash, given the name of its first entry.
+func topDir(name string, isDir bool) string {
+	if isDir {
+		return strings.SplitAfterN(name, "/", 2)[0]
+	}
+
+	return strings.SplitN(name, "/", 2)[0] + "/"
+}
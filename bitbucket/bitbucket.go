@@ -4,39 +4,75 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"path"
 	"time"
 
 	"github.com/marwan-at-work/gdp"
 	"github.com/pkg/errors"
 )
 
-// New maybe needs credentials?
-func New() gdp.CodeHost {
-	return &client{}
+// Option configures the CodeHost returned by New.
+type Option func(*client)
+
+// WithAppPassword authenticates every request as
+// user with one of their app passwords.
+func WithAppPassword(user, password string) Option {
+	return func(c *client) {
+		c.auth = func(req *http.Request) { req.SetBasicAuth(user, password) }
+	}
+}
+
+// WithOAuthToken authenticates every request with an OAuth
+// access token, or a repository, project or workspace token.
+func WithOAuthToken(tok string) Option {
+	return func(c *client) {
+		c.auth = func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+tok) }
+	}
+}
+
+// New returns a Bitbucket Cloud implementation of the CodeHost
+// api. Without options, only public repositories can be reached.
+// Use gdp.New to create a download protocol out of it.
+func New(opts ...Option) gdp.CodeHost {
+	c := &client{
+		apiURL: "https://api.bitbucket.org/2.0",
+		webURL: "https://bitbucket.org",
+		auth:   func(*http.Request) {},
+		c:      http.DefaultClient,
+	}
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
+}
+
+type client struct {
+	apiURL string
+	webURL string
+	auth   func(*http.Request)
+	c      *http.Client
 }
 
-type client struct{}
+const pageLen = 100
 
 func (c *client) Branches(ctx context.Context, owner string, repo string) ([]string, error) {
-	return nil, errors.New("bitbucket: unimplemented")
+	branches, err := c.refs(ctx, c.branchesURL(owner, repo))
+	if err != nil {
+		return nil, errors.Wrap(err, "bitbucket.Branches")
+	}
+
+	return branches, nil
 }
 
 func (c *client) Tags(ctx context.Context, owner, repo string) ([]string, error) {
-	url := c.tagsURL(owner, repo)
-	resp, err := http.Get(url)
+	tags, err := c.refs(ctx, c.tagsURL(owner, repo))
 	if err != nil {
-		return nil, errors.Wrap(err, "bitbucketList.httpGet")
-	}
-	defer resp.Body.Close()
-	var tr tagsResponse
-	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil {
-		return nil, errors.Wrap(err, "bitbucketList.decode")
-	}
-	tags := []string{}
-	for _, t := range tr.Values {
-		tags = append(tags, t.Name)
+		return nil, errors.Wrap(err, "bitbucket.Tags")
 	}
 
 	return tags, nil
@@ -44,18 +80,9 @@ func (c *client) Tags(ctx context.Context, owner, repo string) ([]string, error)
 
 func (c *client) CommitInfo(ctx context.Context, owner, repo, sha string) (*gdp.RevInfo, error) {
 	var ri gdp.RevInfo
-	u := c.commitURL(owner, repo, sha)
-	resp, err := http.Get(u)
-	if err != nil {
-		return nil, errors.Wrap(err, "infoFromSha.httpGet")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%v unexpected code %v from infoFromSha", u, resp.StatusCode)
-	}
 	var cmt commit
-	if err = json.NewDecoder(resp.Body).Decode(&cmt); err != nil {
-		return nil, errors.Wrap(err, "infoFromSha.decode")
+	if err := c.getJSON(ctx, c.commitURL(owner, repo, sha), &cmt); err != nil {
+		return nil, errors.Wrap(err, "infoFromSha")
 	}
 
 	ri.Name = cmt.Hash
@@ -68,18 +95,9 @@ func (c *client) CommitInfo(ctx context.Context, owner, repo, sha string) (*gdp.
 
 func (c *client) TagInfo(ctx context.Context, owner, repo, tag string) (*gdp.RevInfo, error) {
 	var ri gdp.RevInfo
-	u := c.tagRefURL(owner, repo, tag)
-	resp, err := http.Get(u)
-	if err != nil {
-		return nil, errors.Wrap(err, "infoFromTag.httpGet")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("infoFromTag %v unexpected status %v", u, resp.StatusCode)
-	}
 	var tr tagRefResponse
-	if err = json.NewDecoder(resp.Body).Decode(&tr); err != nil {
-		return nil, errors.Wrap(err, "infoFromTag.decode")
+	if err := c.getJSON(ctx, c.tagRefURL(owner, repo, tag), &tr); err != nil {
+		return nil, errors.Wrap(err, "infoFromTag")
 	}
 
 	ri.Name = tr.Target.Hash
@@ -91,48 +109,28 @@ func (c *client) TagInfo(ctx context.Context, owner, repo, tag string) (*gdp.Rev
 }
 
 func (c *client) LatestCommit(ctx context.Context, owner, repo string) (sha string, t time.Time, err error) {
-	u := c.repoURL(owner, repo)
-	resp, err := http.Get(u)
-	if err != nil {
-		return "", time.Time{}, errors.Wrap(err, "bitbucketLatest.httpGet")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return "", time.Time{}, fmt.Errorf("bitbucketLatest.httpGet unexpected response code %v", resp.StatusCode)
-	}
 	var rr repoResponse
-	if err = json.NewDecoder(resp.Body).Decode(&rr); err != nil {
-		return "", time.Time{}, errors.Wrap(err, "bitbucketLatest.jsonDecode")
+	if err = c.getJSON(ctx, c.repoURL(owner, repo), &rr); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "bitbucketLatest")
 	}
 
-	u = c.branchRefURL(owner, repo, rr.Mainbranch.Name)
-	resp, err = http.Get(u)
-	if err != nil {
-		return "", time.Time{}, errors.Wrap(err, "bitbucketLatest.httpGetBranch")
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		return "", time.Time{}, fmt.Errorf("bitbucketLatest.httpGetBranch unexpected response code %v", resp.StatusCode)
-	}
 	var br branchRefResponse
-	if err = json.NewDecoder(resp.Body).Decode(&br); err != nil {
-		return "", time.Time{}, errors.Wrap(err, "bitbucketLatest.jsonDecodeBranch")
+	if err = c.getJSON(ctx, c.branchRefURL(owner, repo, rr.Mainbranch.Name), &br); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "bitbucketLatest.branch")
 	}
 
 	return br.Target.Hash, br.Target.Date, nil
 }
 
-func (c *client) GetModFile(ctx context.Context, owner, repo, version string) ([]byte, error) {
-	u := c.contentURL(owner, repo, version, "go.mod")
-	resp, err := http.Get(u)
+func (c *client) GetModFile(ctx context.Context, owner, repo, dir, version string) ([]byte, error) {
+	u := c.contentURL(owner, repo, version, path.Join(dir, "go.mod"))
+	resp, err := c.get(ctx, u)
 	if err != nil {
-		return nil, errors.Wrap(err, "goModFromTag.httpGet")
+		return nil, errors.Wrap(err, "goModFromTag")
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, gdp.ErrNotFound
-	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("%v returned %v at goModFromTag", u, resp.StatusCode)
+	if err := gdp.CheckResponse(resp); err != nil {
+		return nil, err
 	}
 	bts, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -146,16 +144,93 @@ func (c *client) TarURL(ctx context.Context, owner, repo, version string) (strin
 	return c.tarURL(owner, repo, version), nil
 }
 
+// Archive downloads the tarball with the request
+// context and the credentials of the client.
+func (c *client) Archive(ctx context.Context, owner, repo, ref string) (io.ReadCloser, gdp.ArchiveFormat, error) {
+	resp, err := c.get(ctx, c.tarURL(owner, repo, ref))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "bitbucketArchive")
+	}
+	if err := gdp.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+
+	return resp.Body, gdp.ArchiveTarGz, nil
+}
+
+// refs returns the names of the branches or tags
+// at u, following the next link of every page. The
+// credentials are only sent along to the api itself.
+func (c *client) refs(ctx context.Context, u string) ([]string, error) {
+	names := []string{}
+	for u != "" {
+		var page refsResponse
+		if err := c.getJSON(ctx, u, &page); err != nil {
+			return nil, err
+		}
+		for _, r := range page.Values {
+			names = append(names, r.Name)
+		}
+		u = page.Next
+		if u != "" && !sameOrigin(u, c.apiURL) {
+			return nil, fmt.Errorf("next page %v is not on %v", u, c.apiURL)
+		}
+	}
+
+	return names, nil
+}
+
+// sameOrigin reports whether the urls a and b
+// have the same scheme and host, port included.
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return ua.Scheme == ub.Scheme && ua.Host == ub.Host
+}
+
+func (c *client) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.auth(req)
+	resp, err := c.c.Do(req.WithContext(ctx))
+
+	return resp, gdp.Unavailable(err)
+}
+
+func (c *client) getJSON(ctx context.Context, u string, v interface{}) error {
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, "httpGet")
+	}
+	defer resp.Body.Close()
+	if err := gdp.CheckResponse(resp); err != nil {
+		return err
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "jsonDecode")
+}
+
 func (c *client) contentURL(owner, repo, tag, path string) string {
 	return fmt.Sprintf(
-		"https://api.bitbucket.org/2.0/repositories/%v/%v/src/%v/%v",
-		owner, repo, tag, path,
+		"%v/repositories/%v/%v/src/%v/%v",
+		c.apiURL, owner, repo, tag, path,
 	)
 }
 
 func (c *client) tarURL(owner, repo, ref string) string {
 	return fmt.Sprintf(
-		"https://bitbucket.org/%v/%v/get/%v.tar.gz",
+		"%v/%v/%v/get/%v.tar.gz",
+		c.webURL,
 		owner,
 		repo,
 		ref,
@@ -169,7 +244,8 @@ type commit struct {
 
 func (c *client) commitURL(owner, repo, sha string) string {
 	return fmt.Sprintf(
-		"https://api.bitbucket.org/2.0/repositories/%v/%v/commit/%v",
+		"%v/repositories/%v/%v/commit/%v",
+		c.apiURL,
 		owner,
 		repo,
 		sha,
@@ -183,24 +259,39 @@ type tagRefResponse struct {
 
 func (c *client) tagRefURL(owner, repo, tag string) string {
 	return fmt.Sprintf(
-		"https://api.bitbucket.org/2.0/repositories/%v/%v/refs/tags/%v",
+		"%v/repositories/%v/%v/refs/tags/%v",
+		c.apiURL,
 		owner,
 		repo,
 		tag,
 	)
 }
 
-type tagsResponse struct {
+type refsResponse struct {
 	Values []struct {
 		Name string `json:"name"`
 	} `json:"values"`
+	// Next is the url of the next page, if any.
+	Next string `json:"next"`
 }
 
 func (c *client) tagsURL(owner, repo string) string {
 	return fmt.Sprintf(
-		"https://api.bitbucket.org/2.0/repositories/%v/%v/refs/tags",
+		"%v/repositories/%v/%v/refs/tags?pagelen=%v",
+		c.apiURL,
+		owner,
+		repo,
+		pageLen,
+	)
+}
+
+func (c *client) branchesURL(owner, repo string) string {
+	return fmt.Sprintf(
+		"%v/repositories/%v/%v/refs/branches?pagelen=%v",
+		c.apiURL,
 		owner,
 		repo,
+		pageLen,
 	)
 }
 
@@ -212,7 +303,8 @@ type repoResponse struct {
 
 func (c *client) repoURL(owner, repo string) string {
 	return fmt.Sprintf(
-		"https://api.bitbucket.org/2.0/repositories/%v/%v",
+		"%v/repositories/%v/%v",
+		c.apiURL,
 		owner,
 		repo,
 	)
@@ -224,7 +316,8 @@ type branchRefResponse struct {
 
 func (c *client) branchRefURL(owner, repo, branch string) string {
 	return fmt.Sprintf(
-		"https://api.bitbucket.org/2.0/repositories/%v/%v/refs/branches/%v",
+		"%v/repositories/%v/%v/refs/branches/%v",
+		c.apiURL,
 		owner,
 		repo,
 		branch,
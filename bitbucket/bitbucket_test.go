@@ -3,10 +3,16 @@ package bitbucket
 import (
 	"archive/zip"
 	"context"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 )
 
@@ -75,3 +81,115 @@ func TestZip(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// fakeAPI stands in for the subset of the Bitbucket Cloud 2.0 API
+// used by the client, serving a single private repository:
+// owner/repo. Its tags are split across two pages.
+func fakeAPI(t *testing.T) *httptest.Server {
+	const repo = "/2.0/repositories/owner/repo"
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "user" || pass != "pass" {
+			if r.Header.Get("Authorization") != "Bearer tok" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		switch p := r.URL.Path; p {
+		case repo + "/refs/tags":
+			if r.URL.Query().Get("page") == "" {
+				fmt.Fprintf(w, `{"values": [{"name": "v0.2.0"}], "next": %q}`, srv.URL+repo+"/refs/tags?pagelen=100&page=2")
+				return
+			}
+			fmt.Fprint(w, `{"values": [{"name": "v0.1.0"}]}`)
+		case repo + "/refs/branches":
+			fmt.Fprint(w, `{"values": [{"name": "master"}, {"name": "dev"}]}`)
+		case "/2.0/repositories/owner/busy/refs/tags":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/2.0/repositories/owner/slow/refs/tags":
+			<-r.Context().Done()
+		default:
+			t.Logf("unexpected path %v", p)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return srv
+}
+
+func testClient(srv *httptest.Server, opts ...Option) *client {
+	c := New(opts...).(*client)
+	c.apiURL = srv.URL + "/2.0"
+	c.webURL = srv.URL
+
+	return c
+}
+
+func TestPages(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	for _, opt := range []Option{WithAppPassword("user", "pass"), WithOAuthToken("tok")} {
+		c := testClient(srv, opt)
+		tags, err := c.Tags(ctx, "owner", "repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tags, []string{"v0.2.0", "v0.1.0"}) {
+			t.Fatalf("unexpected tags %v", tags)
+		}
+		branches, err := c.Branches(ctx, "owner", "repo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(branches, []string{"master", "dev"}) {
+			t.Fatalf("unexpected branches %v", branches)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+	c := testClient(srv, WithAppPassword("user", "pass"))
+
+	_, err := testClient(srv).Tags(ctx, "owner", "repo")
+	if !errors.Is(err, gdp.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized but got %v", err)
+	}
+	_, err = c.Tags(ctx, "owner", "missing")
+	if !errors.Is(err, gdp.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+	_, err = c.Tags(ctx, "owner", "busy")
+	var rle *gdp.RateLimitError
+	if !errors.As(err, &rle) || rle.RetryAfter != 30*time.Second {
+		t.Fatalf("expected a RateLimitError but got %v", err)
+	}
+
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = c.Tags(cctx, "owner", "slow")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the request to be canceled but got %v", err)
+	}
+}
+
+func TestForeignNextPage(t *testing.T) {
+	var leaked bool
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaked = r.Header.Get("Authorization") != ""
+		fmt.Fprint(w, `{"values": [{"name": "v0.1.0"}]}`)
+	}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"values": [{"name": "v0.2.0"}], "next": %q}`, other.URL+"/2.0/repositories/owner/repo/refs/tags?page=2")
+	}))
+	defer srv.Close()
+
+	_, err := testClient(srv, WithOAuthToken("tok")).Tags(ctx, "owner", "repo")
+	if err == nil || leaked {
+		t.Fatalf("expected the next page of another host not to be fetched, leaked: %v, err: %v", leaked, err)
+	}
+}
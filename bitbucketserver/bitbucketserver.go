@@ -0,0 +1,291 @@
+package bitbucketserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+)
+
+// New returns a Bitbucket Server (or Data Center) implementation
+// of the CodeHost api that talks to the 1.0 REST API of the instance
+// at baseURL such as https://bitbucket.mycorp.com. tok is an optional
+// personal access token. Use gdp.New to create a download protocol
+// out of it.
+//
+// Module paths follow the clone urls of the instance, such as
+// bitbucket.mycorp.com/scm/proj/repo for the repo repository of
+// the PROJ project, and the scm element may be left out.
+func New(baseURL, tok string) gdp.CodeHost {
+	return &client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   tok,
+		c:       http.DefaultClient,
+	}
+}
+
+type client struct {
+	baseURL string
+	token   string
+	c       *http.Client
+}
+
+const pageLimit = 100
+
+// SplitModule maps host/scm/project/repo/dir, or host/project/repo/dir,
+// to the key of the project and the slug of the repository. Personal
+// repositories are under the ~user project, as in their clone urls.
+func (c *client) SplitModule(module string) (project, repo, dir string, err error) {
+	els := strings.Split(module, "/")
+	if len(els) > 1 && els[1] == "scm" {
+		els = append(els[:1], els[2:]...)
+	}
+	if len(els) < 3 || els[1] == "" || els[2] == "" {
+		return "", "", "", errors.Wrap(gdp.ErrNotFound, "bitbucketserver.SplitModule: unparsable path: "+module)
+	}
+
+	return els[1], strings.TrimSuffix(els[2], ".git"), strings.Join(els[3:], "/"), nil
+}
+
+func (c *client) Tags(ctx context.Context, project, repo string) ([]string, error) {
+	tags, err := c.refs(ctx, c.repoURL(project, repo)+"/tags")
+	if err != nil {
+		return nil, errors.Wrap(err, "bitbucketserver.Tags")
+	}
+
+	return tags, nil
+}
+
+func (c *client) Branches(ctx context.Context, project, repo string) ([]string, error) {
+	branches, err := c.refs(ctx, c.repoURL(project, repo)+"/branches")
+	if err != nil {
+		return nil, errors.Wrap(err, "bitbucketserver.Branches")
+	}
+
+	return branches, nil
+}
+
+func (c *client) CommitInfo(ctx context.Context, project, repo, sha string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	cmt, err := c.commit(ctx, project, repo, sha)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bitbucketserver.CommitInfo failed for %v/%v@%v", project, repo, sha)
+	}
+
+	ri.Name = cmt.ID
+	ri.Short = ri.Name[:12]
+	ri.Time = cmt.time()
+	ri.Version = gdp.Pseudo(ri.Time, ri.Short)
+
+	return &ri, nil
+}
+
+func (c *client) TagInfo(ctx context.Context, project, repo, tag string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	cmt, err := c.commit(ctx, project, repo, "refs/tags/"+tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bitbucketserver.TagInfo failed for %v/%v@%v", project, repo, tag)
+	}
+
+	ri.Name = cmt.ID
+	ri.Short = tag
+	ri.Version = tag
+	ri.Time = cmt.time()
+
+	return &ri, nil
+}
+
+func (c *client) LatestCommit(ctx context.Context, project, repo string) (sha string, t time.Time, err error) {
+	cmt, err := c.commit(ctx, project, repo, "")
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "bitbucketserver.LatestCommit")
+	}
+
+	return cmt.ID, cmt.time(), nil
+}
+
+// IsAncestor lists the commits reachable from ancestor but not from
+// rev, of which there are none when ancestor is reachable from rev.
+func (c *client) IsAncestor(ctx context.Context, project, repo, ancestor, rev string) (bool, error) {
+	var cr commitsResponse
+	u := c.repoURL(project, repo) + "/commits?limit=1&until=" + url.QueryEscape(ancestor) + "&since=" + url.QueryEscape(rev)
+	if err := c.getJSON(ctx, u, &cr); err != nil {
+		return false, errors.Wrap(err, "bitbucketserver.IsAncestor")
+	}
+
+	return len(cr.Values) == 0, nil
+}
+
+func (c *client) GetModFile(ctx context.Context, project, repo, dir, version string) ([]byte, error) {
+	u := c.repoURL(project, repo) + "/raw/" + escapePath(path.Join(dir, "go.mod")) + "?at=" + url.QueryEscape(version)
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "bitbucketserver.GetModFile")
+	}
+	defer resp.Body.Close()
+	if err := gdp.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	bts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "bitbucketserver.readAll")
+	}
+
+	return bts, nil
+}
+
+// TarURL returns the archive endpoint, with the repository under a
+// top level directory as generic expects. It carries no credentials,
+// private repositories are downloaded through Archive instead.
+func (c *client) TarURL(ctx context.Context, project, repo, version string) (string, error) {
+	return c.repoURL(project, repo) + "/archive?format=tar.gz&prefix=" + url.QueryEscape(repo+"/") + "&at=" + url.QueryEscape(version), nil
+}
+
+// Archive downloads the tarball with the token header.
+func (c *client) Archive(ctx context.Context, project, repo, ref string) (io.ReadCloser, gdp.ArchiveFormat, error) {
+	u, _ := c.TarURL(ctx, project, repo, ref)
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "bitbucketserver.Archive")
+	}
+	if err := gdp.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+
+	return resp.Body, gdp.ArchiveTarGz, nil
+}
+
+// commit returns the commit that rev, any commit-ish, points
+// to. An empty rev stands for the head of the default branch.
+func (c *client) commit(ctx context.Context, project, repo, rev string) (*commitResponse, error) {
+	var cr commitsResponse
+	u := c.repoURL(project, repo) + "/commits?limit=1"
+	if rev != "" {
+		u += "&until=" + url.QueryEscape(rev)
+	}
+	if err := c.getJSON(ctx, u, &cr); err != nil {
+		return nil, err
+	}
+	if len(cr.Values) == 0 {
+		return nil, gdp.ErrNotFound
+	}
+
+	return &cr.Values[0], nil
+}
+
+// refs returns the names of the branches or
+// tags at u, going through all of their pages.
+func (c *client) refs(ctx context.Context, u string) ([]string, error) {
+	names := []string{}
+	for start := 0; ; {
+		var rr refsResponse
+		pu := u + "?limit=" + strconv.Itoa(pageLimit) + "&start=" + strconv.Itoa(start)
+		if err := c.getJSON(ctx, pu, &rr); err != nil {
+			return nil, errors.Wrapf(err, "page at %v", start)
+		}
+		for _, r := range rr.Values {
+			names = append(names, r.DisplayID)
+		}
+		if rr.IsLastPage || rr.NextPageStart <= start {
+			return names, nil
+		}
+		start = rr.NextPageStart
+	}
+}
+
+func (c *client) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.c.Do(req.WithContext(ctx))
+
+	return resp, gdp.Unavailable(err)
+}
+
+func (c *client) getJSON(ctx context.Context, u string, v interface{}) error {
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, "httpGet")
+	}
+	defer resp.Body.Close()
+	if err := gdp.CheckResponse(resp); err != nil {
+		return err
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "jsonDecode")
+}
+
+func (c *client) repoURL(project, repo string) string {
+	return fmt.Sprintf(
+		"%v/rest/api/1.0/%v/%v/repos/%v",
+		c.baseURL,
+		projectsOrUsers(project),
+		url.PathEscape(strings.TrimPrefix(project, "~")),
+		url.PathEscape(repo),
+	)
+}
+
+// projectsOrUsers returns the collection of the project of
+// a repository, where personal ones are under their user.
+func projectsOrUsers(project string) string {
+	if strings.HasPrefix(project, "~") {
+		return "users"
+	}
+
+	return "projects"
+}
+
+// escapePath escapes every element of a slash separated path.
+func escapePath(p string) string {
+	els := strings.Split(p, "/")
+	for i, el := range els {
+		els[i] = url.PathEscape(el)
+	}
+
+	return strings.Join(els, "/")
+}
+
+type refsResponse struct {
+	Values []struct {
+		DisplayID string `json:"displayId"`
+	} `json:"values"`
+	IsLastPage    bool `json:"isLastPage"`
+	NextPageStart int  `json:"nextPageStart"`
+}
+
+type commitsResponse struct {
+	Values []commitResponse `json:"values"`
+}
+
+type commitResponse struct {
+	ID string `json:"id"`
+	// timestamps are in milliseconds since the epoch, and
+	// only recent versions know when a commit was committed.
+	AuthorTimestamp    int64 `json:"authorTimestamp"`
+	CommitterTimestamp int64 `json:"committerTimestamp"`
+}
+
+func (c *commitResponse) time() time.Time {
+	ms := c.CommitterTimestamp
+	if ms == 0 {
+		ms = c.AuthorTimestamp
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond)).UTC()
+}
@@ -0,0 +1,155 @@
+package bitbucketserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/internal/testhost"
+)
+
+const (
+	sha    = testhost.SHA
+	head   = "816c9085562cd7ee03e7f8188a1cfd942858cded"
+	module = "bitbucket.mycorp.com/scm/proj/repo"
+)
+
+var ctx = context.Background()
+
+// fakeAPI stands in for the subset of the Bitbucket Server 1.0 REST
+// API used by the client, serving a single repository: proj/repo,
+// with v0.2.0 tagged at sha and the default branch one commit ahead.
+func fakeAPI(t *testing.T) *httptest.Server {
+	const repo = "/rest/api/1.0/projects/proj/repos/repo"
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		switch p := r.URL.Path; p {
+		case repo + "/tags":
+			if q.Get("start") == "0" {
+				fmt.Fprint(w, `{"values": [{"displayId": "v0.2.0"}], "isLastPage": false, "nextPageStart": 1}`)
+				return
+			}
+			fmt.Fprint(w, `{"values": [{"displayId": "v0.1.0"}], "isLastPage": true}`)
+		case repo + "/branches":
+			fmt.Fprint(w, `{"values": [{"displayId": "master"}, {"displayId": "dev"}], "isLastPage": true}`)
+		case repo + "/commits":
+			switch until, since := q.Get("until"), q.Get("since"); {
+			case since == head && until == "v0.2.0":
+				fmt.Fprint(w, `{"values": []}`)
+			case since == "v0.2.0" && until == head:
+				fmt.Fprintf(w, `{"values": [{"id": %q}]}`, head)
+			case since != "":
+				w.WriteHeader(http.StatusNotFound)
+			case until == "refs/tags/v0.2.0" || until == sha[:12]:
+				fmt.Fprintf(w, `{"values": [{"id": %q, "authorTimestamp": 1475113681000}]}`, sha)
+			case until == "" || until == "master":
+				fmt.Fprintf(w, `{"values": [{"id": %q, "authorTimestamp": 1, "committerTimestamp": 1520804715000}]}`, head)
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case repo + "/raw/go.mod":
+			if q.Get("at") != "v0.2.0" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, "module "+module+"\n")
+		case repo + "/archive":
+			if q.Get("at") != "v0.2.0" || q.Get("format") != "tar.gz" || q.Get("prefix") != "repo/" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(testhost.Tarball(t, "repo/", testhost.Files(module)))
+		default:
+			t.Logf("unexpected path %v", p)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestSplitModule(t *testing.T) {
+	c := New("https://bitbucket.mycorp.com", "").(*client)
+	for path, expected := range map[string][3]string{
+		"bitbucket.mycorp.com/scm/proj/repo":         {"proj", "repo", ""},
+		"bitbucket.mycorp.com/scm/proj/repo.git":     {"proj", "repo", ""},
+		"bitbucket.mycorp.com/proj/repo/sub/dir":     {"proj", "repo", "sub/dir"},
+		"bitbucket.mycorp.com/scm/~jdoe/repo/sub":    {"~jdoe", "repo", "sub"},
+		"bitbucket.mycorp.com/scm/proj/repo/scm/dir": {"proj", "repo", "scm/dir"},
+	} {
+		project, repo, dir, err := c.SplitModule(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if [3]string{project, repo, dir} != expected {
+			t.Fatalf("unexpected split %v %v %v of %v", project, repo, dir, path)
+		}
+	}
+	if _, _, _, err := c.SplitModule("bitbucket.mycorp.com/scm/proj"); err == nil {
+		t.Fatal("expected an error for a path without a repository")
+	}
+
+	if u := c.repoURL("~jdoe", "repo"); u != "https://bitbucket.mycorp.com/rest/api/1.0/users/jdoe/repos/repo" {
+		t.Fatalf("unexpected url of a personal repository %v", u)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	testhost.Run(t, gdp.New(New(srv.URL, "tok")), module)
+}
+
+func TestBranches(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	branches, err := New(srv.URL, "tok").Branches(ctx, "proj", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(branches, []string{"master", "dev"}) {
+		t.Fatalf("unexpected branches %v", branches)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+	d := gdp.New(New(srv.URL, "tok"))
+
+	// the default branch is one commit ahead of v0.2.0.
+	info, err := d.Latest(ctx, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != head || info.Version != "v0.2.1-0.20180311214515-"+head[:12] {
+		t.Fatalf("unexpected rev info %#v", info)
+	}
+	ac := New(srv.URL, "tok").(gdp.AncestorChecker)
+	if ok, err := ac.IsAncestor(ctx, "proj", "repo", head, "v0.2.0"); err != nil || ok {
+		t.Fatalf("expected %v not to be an ancestor: %v", head, err)
+	}
+
+	_, err = d.Info(ctx, "bitbucket.mycorp.com/scm/proj/missing", "v0.2.0")
+	if err == nil {
+		t.Fatal("expected an error for a missing repository")
+	}
+}
+
+func TestGetModFile(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	_, err := New(srv.URL, "tok").GetModFile(ctx, "proj", "repo", "", "v0.1.0")
+	if err != gdp.ErrNotFound {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+}
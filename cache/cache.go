@@ -0,0 +1,241 @@
+// Package cache wraps a gdp.DownloadProtocol to serve
+// what it already fetched from a pluggable Storage.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/internal/autoclose"
+	"github.com/marwan-at-work/vgop/semver"
+	"github.com/pkg/errors"
+	gomodule "golang.org/x/mod/module"
+)
+
+// Storage stores files by their path in the GOPROXY layout,
+// such as github.com/!burnt!sushi/toml/@v/v0.3.1.zip, so that
+// a storage can be served as a GOPROXY itself. Implementations
+// must be safe for concurrent use and must not expose a file
+// until all of it was put.
+type Storage interface {
+	// Get returns the file at key and when it was put,
+	// or gdp.ErrNotFound if there's none.
+	Get(ctx context.Context, key string) (io.ReadCloser, time.Time, error)
+	Put(ctx context.Context, key string, r io.Reader) error
+}
+
+// New returns a DownloadProtocol that caches what dp returns in s.
+// Zips, go.mod files and the info of versions never change, so they
+// are kept forever, while lists and latest versions are fetched
+// again once they are older than ttl.
+func New(dp gdp.DownloadProtocol, s Storage, ttl time.Duration) gdp.DownloadProtocol {
+	return &cache{dp, s, ttl}
+}
+
+type cache struct {
+	dp  gdp.DownloadProtocol
+	s   Storage
+	ttl time.Duration
+}
+
+func (c *cache) List(ctx context.Context, module string) ([]string, error) {
+	key, err := moduleKey(module, "/@v/list")
+	if err != nil {
+		return nil, err
+	}
+	if bts, ok := c.get(ctx, key, true); ok {
+		if len(bts) == 0 {
+			return []string{}, nil
+		}
+		return strings.Split(string(bts), "\n"), nil
+	}
+	vers, err := c.dp.List(ctx, module)
+	if err != nil {
+		return nil, err
+	}
+	c.put(ctx, key, []byte(strings.Join(vers, "\n")))
+
+	return vers, nil
+}
+
+func (c *cache) Info(ctx context.Context, module, version string) (*gdp.RevInfo, error) {
+	if !immutable(version) {
+		// a query such as a branch name moves, but
+		// what it resolves to doesn't.
+		info, err := c.dp.Info(ctx, module, version)
+		if err == nil && immutable(info.Version) {
+			c.putInfo(ctx, module, info.Version, info)
+		}
+		return info, err
+	}
+	key, err := versionKey(module, version, ".info")
+	if err != nil {
+		return nil, err
+	}
+	if info, ok := c.getInfo(ctx, key, false); ok {
+		return info, nil
+	}
+	info, err := c.dp.Info(ctx, module, version)
+	if err != nil {
+		return nil, err
+	}
+	// the version may resolve to another one, such as v2.0.0 to
+	// v2.0.0+incompatible, which is looked up by either of them.
+	c.putInfo(ctx, module, version, info)
+	if info.Version != version && immutable(info.Version) {
+		c.putInfo(ctx, module, info.Version, info)
+	}
+
+	return info, nil
+}
+
+func (c *cache) Latest(ctx context.Context, module string) (*gdp.RevInfo, error) {
+	key, err := moduleKey(module, "/@latest")
+	if err != nil {
+		return nil, err
+	}
+	if info, ok := c.getInfo(ctx, key, true); ok {
+		return info, nil
+	}
+	info, err := c.dp.Latest(ctx, module)
+	if err != nil {
+		return nil, err
+	}
+	if bts, err := json.Marshal(info); err == nil {
+		c.put(ctx, key, bts)
+	}
+
+	return info, nil
+}
+
+func (c *cache) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	if !immutable(version) {
+		return c.dp.GoMod(ctx, module, version)
+	}
+	key, err := versionKey(module, version, ".mod")
+	if err != nil {
+		return nil, err
+	}
+	if bts, ok := c.get(ctx, key, false); ok {
+		return bts, nil
+	}
+	bts, err := c.dp.GoMod(ctx, module, version)
+	if err != nil {
+		return nil, err
+	}
+	c.put(ctx, key, bts)
+
+	return bts, nil
+}
+
+// Zip puts the whole zip in the storage before returning
+// it from there, so that a failed download is never cached.
+func (c *cache) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
+	// a zip prefix changes what's in the zip.
+	if !immutable(version) || zipPrefix != "" {
+		return c.dp.Zip(ctx, module, version, zipPrefix)
+	}
+	key, err := versionKey(module, version, ".zip")
+	if err != nil {
+		return nil, err
+	}
+	if rc, _, err := c.s.Get(ctx, key); err == nil {
+		return autoclose.New(rc, rc.Close), nil
+	}
+	rdr, err := c.dp.Zip(ctx, module, version, zipPrefix)
+	if err != nil {
+		return nil, err
+	}
+	// a failed put may stop reading half way, so rdr
+	// is closed to release what's behind it either way.
+	err = c.s.Put(ctx, key, rdr)
+	gdp.CloseReader(rdr)
+	if err != nil {
+		return nil, errors.Wrap(err, "cache.put")
+	}
+	rc, _, err := c.s.Get(ctx, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cache.get")
+	}
+
+	return autoclose.New(rc, rc.Close), nil
+}
+
+// get returns the file at key, unless it's older than the
+// ttl for mutable files. Storage errors are cache misses.
+func (c *cache) get(ctx context.Context, key string, mutable bool) ([]byte, bool) {
+	rc, t, err := c.s.Get(ctx, key)
+	if err != nil {
+		return nil, false
+	}
+	defer rc.Close()
+	if mutable && time.Since(t) > c.ttl {
+		return nil, false
+	}
+	bts, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, false
+	}
+
+	return bts, true
+}
+
+// put ignores errors since the
+// upstream result is still good.
+func (c *cache) put(ctx context.Context, key string, bts []byte) {
+	c.s.Put(ctx, key, bytes.NewReader(bts))
+}
+
+func (c *cache) getInfo(ctx context.Context, key string, mutable bool) (*gdp.RevInfo, bool) {
+	bts, ok := c.get(ctx, key, mutable)
+	if !ok {
+		return nil, false
+	}
+	var info gdp.RevInfo
+	if err := json.Unmarshal(bts, &info); err != nil {
+		return nil, false
+	}
+
+	return &info, true
+}
+
+func (c *cache) putInfo(ctx context.Context, module, version string, info *gdp.RevInfo) {
+	key, err := versionKey(module, version, ".info")
+	if err != nil {
+		return
+	}
+	if bts, err := json.Marshal(info); err == nil {
+		c.put(ctx, key, bts)
+	}
+}
+
+// immutable reports whether version names a single
+// revision for good, which tags and pseudo-versions do.
+func immutable(version string) bool {
+	return semver.IsValid(version) && semver.Canonical(version) == strings.TrimSuffix(version, "+incompatible") ||
+		gdp.IsPseudo(version)
+}
+
+func moduleKey(module, suffix string) (string, error) {
+	path, err := gomodule.EscapePath(module)
+	if err != nil {
+		return "", errors.Wrap(err, "cache.escapePath")
+	}
+
+	return path + suffix, nil
+}
+
+func versionKey(module, version, ext string) (string, error) {
+	v, err := gomodule.EscapeVersion(version)
+	if err != nil {
+		return "", errors.Wrap(err, "cache.escapeVersion")
+	}
+
+	return moduleKey(module, "/@v/"+v+ext)
+}
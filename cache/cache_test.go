@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+)
+
+var ctx = context.Background()
+
+// countingProtocol counts the calls of each method.
+type countingProtocol struct {
+	calls   map[string]int
+	zipErr  error
+	version string
+	closed  bool
+}
+
+func (c *countingProtocol) List(ctx context.Context, module string) ([]string, error) {
+	c.calls["list"]++
+	return []string{"v1.0.0", "v1.1.0"}, nil
+}
+
+func (c *countingProtocol) Info(ctx context.Context, module, version string) (*gdp.RevInfo, error) {
+	c.calls["info"]++
+	switch {
+	case version == "master":
+		version = c.version
+	case version >= "v2":
+		version += "+incompatible"
+	}
+	return &gdp.RevInfo{Version: version, Time: time.Date(2018, 3, 11, 21, 45, 15, 0, time.UTC)}, nil
+}
+
+func (c *countingProtocol) Latest(ctx context.Context, module string) (*gdp.RevInfo, error) {
+	c.calls["latest"]++
+	return c.Info(ctx, module, "master")
+}
+
+func (c *countingProtocol) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	c.calls["mod"]++
+	return []byte("module " + module + "\n"), nil
+}
+
+func (c *countingProtocol) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
+	c.calls["zip"]++
+	r := strings.NewReader("zip of " + module + "@" + version)
+	if c.zipErr != nil {
+		return &closeRecorder{io.MultiReader(r, &errReader{c.zipErr}), &c.closed}, nil
+	}
+	return r, nil
+}
+
+type errReader struct{ err error }
+
+func (e *errReader) Read([]byte) (int, error) { return 0, e.err }
+
+// closeRecorder records that the upstream zip was closed.
+type closeRecorder struct {
+	io.Reader
+	closed *bool
+}
+
+func (c *closeRecorder) Close() error {
+	*c.closed = true
+	return nil
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, s := range map[string]Storage{"memory": NewMemory(), "disk": NewDisk(dir)} {
+		up := &countingProtocol{calls: map[string]int{}, version: "v1.1.0"}
+		dp := New(up, s, time.Hour)
+		const module = "github.com/Owner/repo"
+		for i := 0; i < 2; i++ {
+			vers, err := dp.List(ctx, module)
+			if err != nil || !reflect.DeepEqual(vers, []string{"v1.0.0", "v1.1.0"}) {
+				t.Fatalf("%v: unexpected list %v: %v", name, vers, err)
+			}
+			info, err := dp.Info(ctx, module, "v1.0.0")
+			if err != nil || info.Version != "v1.0.0" || info.Time.IsZero() {
+				t.Fatalf("%v: unexpected info %v: %v", name, info, err)
+			}
+			if _, err := dp.Latest(ctx, module); err != nil {
+				t.Fatal(err)
+			}
+			mod, err := dp.GoMod(ctx, module, "v1.0.0")
+			if err != nil || string(mod) != "module github.com/Owner/repo\n" {
+				t.Fatalf("%v: unexpected go.mod %s: %v", name, mod, err)
+			}
+			rdr, err := dp.Zip(ctx, module, "v1.0.0", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bts, _ := ioutil.ReadAll(rdr); string(bts) != "zip of github.com/Owner/repo@v1.0.0" {
+				t.Fatalf("%v: unexpected zip %s", name, bts)
+			}
+		}
+		expected := map[string]int{"list": 1, "info": 2, "latest": 1, "mod": 1, "zip": 1}
+		if !reflect.DeepEqual(up.calls, expected) {
+			t.Fatalf("%v: unexpected upstream calls %v", name, up.calls)
+		}
+
+		// branches move, but the info of what they resolve to is cached.
+		up.calls = map[string]int{}
+		for i := 0; i < 2; i++ {
+			if info, err := dp.Info(ctx, module, "master"); err != nil || info.Version != "v1.1.0" {
+				t.Fatalf("%v: unexpected info %v: %v", name, info, err)
+			}
+		}
+		dp.Info(ctx, module, "v1.1.0")
+		if up.calls["info"] != 2 {
+			t.Fatalf("%v: unexpected upstream calls %v", name, up.calls)
+		}
+
+		// lists and latest versions expire.
+		up.calls = map[string]int{}
+		dp = New(up, s, 0)
+		dp.List(ctx, module)
+		dp.Latest(ctx, module)
+		if up.calls["list"] != 1 || up.calls["latest"] != 1 {
+			t.Fatalf("%v: unexpected upstream calls %v", name, up.calls)
+		}
+
+		// a failed download isn't cached.
+		up.zipErr = errors.New("connection reset")
+		if _, err := dp.Zip(ctx, module, "v1.1.0", ""); err == nil || !up.closed {
+			t.Fatalf("%v: expected an error and the upstream zip to be closed: %v", name, err)
+		}
+		up.zipErr = nil
+		rdr, err := dp.Zip(ctx, module, "v1.1.0", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bts, _ := ioutil.ReadAll(rdr); string(bts) != "zip of github.com/Owner/repo@v1.1.0" {
+			t.Fatalf("%v: unexpected zip %s", name, bts)
+		}
+
+		// a version that resolves to +incompatible is cached by both.
+		up.calls = map[string]int{}
+		for _, vers := range []string{"v2.0.0", "v2.0.0", "v2.0.0+incompatible"} {
+			if info, err := dp.Info(ctx, module, vers); err != nil || info.Version != "v2.0.0+incompatible" {
+				t.Fatalf("%v: unexpected info %v: %v", name, info, err)
+			}
+		}
+		if up.calls["info"] != 1 {
+			t.Fatalf("%v: unexpected upstream calls %v", name, up.calls)
+		}
+	}
+
+	// the disk storage is laid out like a GOPROXY.
+	for _, p := range []string{"@v/list", "@latest", "@v/v1.0.0.info", "@v/v1.0.0.mod", "@v/v1.0.0.zip"} {
+		if _, err := os.Stat(filepath.Join(dir, "github.com", "!owner", "repo", p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
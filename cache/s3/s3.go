@@ -0,0 +1,258 @@
+// Package s3 implements a cache.Storage on top of an S3 compatible
+// object store, such as AWS S3 or MinIO, so that replicas of gdp can
+// share their cache. Objects are named after the GOPROXY layout, so
+// the bucket can be served as a GOPROXY by any static file server.
+package s3
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/cache"
+	"github.com/pkg/errors"
+)
+
+// Config describes a bucket and how to reach it.
+type Config struct {
+	// Endpoint is the base url of the object store, such as
+	// https://s3.us-east-1.amazonaws.com or http://localhost:9000.
+	// Buckets are addressed path style, under Endpoint/Bucket.
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is prepended to every object name, for
+	// when the bucket isn't dedicated to the cache.
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// New returns a Storage that keeps files in the bucket of cfg.
+func New(cfg Config) cache.Storage {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	cfg.Endpoint = strings.TrimSuffix(cfg.Endpoint, "/")
+
+	return &storage{cfg}
+}
+
+type storage struct {
+	cfg Config
+}
+
+func (s *storage) Get(ctx context.Context, key string) (io.ReadCloser, time.Time, error) {
+	req, err := s.request(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	s.sign(req, emptySHA256, time.Now())
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "s3.get")
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, time.Time{}, gdp.ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, time.Time{}, responseError(resp)
+	}
+	t, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		resp.Body.Close()
+		return nil, time.Time{}, errors.Wrap(err, "s3.lastModified")
+	}
+
+	return resp.Body, t, nil
+}
+
+// Put spools r to a temporary file first, since
+// S3 wants to know the size and hash of a body
+// before it starts receiving it.
+func (s *storage) Put(ctx context.Context, key string, r io.Reader) error {
+	f, err := ioutil.TempFile("", "gdp-s3")
+	if err != nil {
+		return errors.Wrap(err, "s3.tempFile")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return errors.Wrap(err, "s3.spool")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "s3.seek")
+	}
+
+	req, err := s.request(ctx, http.MethodPut, key, ioutil.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType(key))
+	s.sign(req, hex.EncodeToString(h.Sum(nil)), time.Now())
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "s3.put")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	return nil
+}
+
+func (s *storage) request(ctx context.Context, method, key string, body io.ReadCloser) (*http.Request, error) {
+	name := path.Join(s.cfg.Bucket, s.cfg.Prefix, key)
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3.parseEndpoint")
+	}
+	// object names have ! and @ in them, which S3 wants escaped.
+	u.RawPath = strings.TrimSuffix(u.EscapedPath(), "/") + "/" + escape(name, false)
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "s3.newRequest")
+	}
+	if body != nil {
+		req.Body = body
+	}
+
+	return req.WithContext(ctx), nil
+}
+
+// contentType lets the bucket be served as it is.
+func contentType(key string) string {
+	switch path.Ext(key) {
+	case ".info":
+		return "application/json"
+	case ".zip":
+		return "application/zip"
+	}
+
+	return "text/plain; charset=utf-8"
+}
+
+func responseError(resp *http.Response) error {
+	bts, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %v %v: %v %s", resp.Request.Method, resp.Request.URL.Path, resp.Status, bts)
+}
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds an AWS Signature Version 4 Authorization header to req,
+// signing the host and every header already set on req. See
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *storage) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonReq)
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), day)
+	for _, v := range []string{s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.cfg.AccessKeyID, scope, signed, sig,
+	))
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		vals := append([]string{}, q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			pairs = append(pairs, escape(k, true)+"="+escape(v, true))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// escape is the URI encoding of S3, which only leaves
+// unreserved characters, and slashes in paths, as they are.
+func escape(s string, query bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !query {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
+
+func hexSHA256(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
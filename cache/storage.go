@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+)
+
+// NewMemory returns a Storage that keeps everything in memory,
+// with no eviction, which suits tests and small deployments.
+func NewMemory() Storage {
+	return &memory{files: map[string]memFile{}}
+}
+
+type memFile struct {
+	data []byte
+	t    time.Time
+}
+
+type memory struct {
+	mu    sync.Mutex
+	files map[string]memFile
+}
+
+func (m *memory) Get(ctx context.Context, key string) (io.ReadCloser, time.Time, error) {
+	m.mu.Lock()
+	f, ok := m.files[key]
+	m.mu.Unlock()
+	if !ok {
+		return nil, time.Time{}, gdp.ErrNotFound
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(f.data)), f.t, nil
+}
+
+func (m *memory) Put(ctx context.Context, key string, r io.Reader) error {
+	bts, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.files[key] = memFile{bts, time.Now()}
+	m.mu.Unlock()
+
+	return nil
+}
+
+// NewDisk returns a Storage that keeps files under dir, in
+// the GOPROXY layout, so that dir can be used as a file://
+// GOPROXY or served by any static file server.
+func NewDisk(dir string) Storage {
+	return &disk{dir}
+}
+
+type disk struct {
+	dir string
+}
+
+func (d *disk) path(key string) (string, error) {
+	if path.Clean("/"+key) != "/"+key || strings.Contains(key, "..") {
+		return "", errors.Errorf("invalid cache key %q", key)
+	}
+
+	return filepath.Join(d.dir, filepath.FromSlash(key)), nil
+}
+
+func (d *disk) Get(ctx context.Context, key string) (io.ReadCloser, time.Time, error) {
+	p, err := d.path(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, gdp.ErrNotFound
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, err
+	}
+
+	return f, fi.ModTime(), nil
+}
+
+// Put writes to a temporary file next to the
+// final one and renames it once it's complete.
+func (d *disk) Put(ctx context.Context, key string, r io.Reader) error {
+	p, err := d.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(p), ".tmp-"+filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
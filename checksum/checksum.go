@@ -0,0 +1,111 @@
+// Package checksum computes the go.sum hashes of
+// the modules served by a gdp.DownloadProtocol.
+package checksum
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// Sums are the h1: hashes of a module version,
+// as they appear in go.sum and on sum.golang.org.
+type Sums struct {
+	Zip   string
+	GoMod string
+}
+
+// GoSum returns the two go.sum lines of module at version.
+func (s *Sums) GoSum(module, version string) string {
+	return fmt.Sprintf("%v %v %v\n%v %v/go.mod %v\n", module, version, s.Zip, module, version, s.GoMod)
+}
+
+// Protocol is a DownloadProtocol that can
+// also hash the modules that it serves.
+type Protocol interface {
+	gdp.DownloadProtocol
+	// Sum returns the hashes of the zip and go.mod
+	// that the DownloadProtocol serves for a version.
+	Sum(ctx context.Context, module, version string) (*Sums, error)
+}
+
+// New returns a Protocol that hashes the modules of dp.
+func New(dp gdp.DownloadProtocol) Protocol {
+	return &hasher{dp}
+}
+
+type hasher struct {
+	gdp.DownloadProtocol
+}
+
+func (h *hasher) Sum(ctx context.Context, module, version string) (*Sums, error) {
+	bts, err := h.GoMod(ctx, module, version)
+	if err != nil {
+		return nil, err
+	}
+	modSum, err := HashGoMod(bts)
+	if err != nil {
+		return nil, errors.Wrap(err, "checksum.hashGoMod")
+	}
+	rdr, err := h.Zip(ctx, module, version, "")
+	if err != nil {
+		return nil, err
+	}
+	zipSum, err := HashZip(rdr)
+	gdp.CloseReader(rdr)
+	if err != nil {
+		return nil, errors.Wrap(err, "checksum.hashZip")
+	}
+
+	return &Sums{Zip: zipSum, GoMod: modSum}, nil
+}
+
+// HashGoMod returns the h1: hash of a go.mod file.
+func HashGoMod(bts []byte) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(bts)), nil
+	})
+}
+
+// HashZip returns the h1: hash of a module zip. The zip
+// is spooled to a temporary file since it can't be read
+// before its central directory at the end.
+func HashZip(r io.Reader) (string, error) {
+	f, err := spool(r)
+	if err != nil {
+		return "", errors.Wrap(err, "spool")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	return hashFile(f)
+}
+
+func spool(r io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile("", "gdp-checksum")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func hashFile(f *os.File) (string, error) {
+	return dirhash.HashZip(f.Name(), dirhash.Hash1)
+}
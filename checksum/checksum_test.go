@@ -0,0 +1,197 @@
+package checksum
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// fakeProtocol serves the same module
+// at every version but v2 and above.
+type fakeProtocol struct {
+	gdp.DownloadProtocol
+	mod   string
+	files map[string]string
+}
+
+func (f *fakeProtocol) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	if version >= "v2" {
+		return nil, gdp.ErrNotFound
+	}
+
+	return []byte(f.mod), nil
+}
+
+func (f *fakeProtocol) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
+	if version >= "v2" {
+		return nil, gdp.ErrNotFound
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range f.files {
+		w, _ := zw.Create(module + "@" + version + "/" + name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+
+	return &buf, nil
+}
+
+var fake = &fakeProtocol{
+	mod:   "module github.com/pkg/errors\n",
+	files: map[string]string{"errors.go": "package errors\n"},
+}
+
+func TestSum(t *testing.T) {
+	dp := New(fake)
+	sums, err := dp.Sum(context.Background(), "github.com/pkg/errors", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the go.mod hash is the one of github.com/pkg/errors@v0.9.1,
+	// which has no go.mod, in the go.sum of every module using it.
+	if sums.GoMod != "h1:bwawxfHBFNV+L2hUp1rHADufV3IMtnDRdf1r5NINEl0=" {
+		t.Fatalf("unexpected go.mod hash %v", sums.GoMod)
+	}
+	// the h1: hash of a zip is the sha256 of the sha256sum
+	// output of its files, named by their paths in the zip.
+	if sums.Zip != "h1:1hbkEIefgjkwSdGUYcvi4ytPoiYLvpYT0PzZMW8wsIg=" {
+		t.Fatalf("unexpected zip hash %v", sums.Zip)
+	}
+
+	expected := "github.com/pkg/errors v1.0.0 " + sums.Zip + "\n" +
+		"github.com/pkg/errors v1.0.0/go.mod " + sums.GoMod + "\n"
+	if got := sums.GoSum("github.com/pkg/errors", "v1.0.0"); got != expected {
+		t.Fatalf("unexpected go.sum lines %q", got)
+	}
+
+	if _, err := dp.Sum(context.Background(), "github.com/pkg/errors", "v2.0.0"); err != gdp.ErrNotFound {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	sums, err := New(fake).Sum(ctx, "github.com/pkg/errors", "v1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the checksum database recorded a different zip for v1.1.0.
+	bad := &Sums{Zip: "h1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", GoMod: sums.GoMod}
+	signer, key, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sumdb.NewTestServer(signer, func(path, vers string) ([]byte, error) {
+		if vers == "v1.1.0" {
+			return []byte(bad.GoSum(path, vers)), nil
+		}
+		return []byte(sums.GoSum(path, vers)), nil
+	})
+	srv := httptest.NewServer(sumdb.NewServer(db))
+	defer srv.Close()
+
+	dp, err := Verify(fake, key, WithURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err := dp.Zip(ctx, "github.com/pkg/errors", "v1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum, err := HashZip(rdr); err != nil || sum != sums.Zip {
+		t.Fatalf("unexpected zip %v: %v", sum, err)
+	}
+	if _, err := dp.GoMod(ctx, "github.com/pkg/errors", "v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dp.GoMod(ctx, "github.com/pkg/errors", "v1.1.0"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = dp.Zip(ctx, "github.com/pkg/errors", "v1.1.0", "")
+	if me, ok := err.(*MismatchError); !ok || me.File != "zip" || me.Want != bad.Zip || me.DB != "sum.example.com" {
+		t.Fatalf("expected a zip mismatch but got %v", err)
+	}
+
+	if _, err := dp.Zip(ctx, "github.com/pkg/errors", "v2.0.0", ""); err != gdp.ErrNotFound {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+
+	dp, err = Verify(fake, key, WithURL(srv.URL), WithNoSumDB("github.com/pkg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr, err = dp.Zip(ctx, "github.com/pkg/errors", "v1.1.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(rdr)
+
+	// a caller that stops early closes the zip, which removes it.
+	dp, err = Verify(fake, key, WithURL(srv.URL), WithCacheLimit(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp, err := ioutil.TempDir("", "checksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+	rdr, err = dp.Zip(ctx, "github.com/pkg/errors", "v1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr.Read(make([]byte, 1))
+	if err := gdp.CloseReader(rdr); err != nil {
+		t.Fatal(err)
+	}
+	if fis, _ := ioutil.ReadDir(tmp); len(fis) != 0 {
+		t.Fatalf("expected %v to be removed", fis[0].Name())
+	}
+	if n := dp.(*verifier).cache.Len(); n > 2 {
+		t.Fatalf("expected at most 2 cached tiles but got %v", n)
+	}
+
+	if _, err := Verify(fake, "not a key"); err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+}
+
+func TestVerifyContext(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	_, key, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp, err := Verify(fake, key, WithURL(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := dp.GoMod(ctx, "github.com/pkg/errors", "v1.0.0"); errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatalf("expected the lookup to stop with its context but got %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package checksum
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/internal/autoclose"
+	"github.com/marwan-at-work/gdp/internal/lru"
+	"github.com/pkg/errors"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+)
+
+// MismatchError is returned when a zip or go.mod
+// doesn't match what the checksum database recorded.
+type MismatchError struct {
+	Module, Version string
+	// File is either "zip" or "go.mod".
+	File string
+	Got  string
+	Want string
+	DB   string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf(
+		"checksum mismatch for %v@%v %v: got %v but %v has %v",
+		e.Module, e.Version, e.File, e.Got, e.DB, e.Want,
+	)
+}
+
+// VerifyOption configures the Protocol returned by Verify.
+type VerifyOption func(*verifier)
+
+// WithURL fetches the checksum database from url
+// instead of https:// followed by the name of its key.
+func WithURL(url string) VerifyOption {
+	return func(v *verifier) {
+		v.url = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithHTTPClient makes the requests to the
+// checksum database with c instead of http.DefaultClient.
+func WithHTTPClient(c *http.Client) VerifyOption {
+	return func(v *verifier) {
+		v.hc = c
+	}
+}
+
+// WithCacheLimit caps how many tiles of the checksum database
+// are kept in memory, 16384 by default. The tiles that lookups
+// have read least recently are dropped first.
+func WithCacheLimit(n int) VerifyOption {
+	return func(v *verifier) {
+		v.limit = n
+	}
+}
+
+// WithNoSumDB skips verification of the modules matching the
+// comma separated path prefix patterns, just like GONOSUMDB.
+func WithNoSumDB(patterns string) VerifyOption {
+	return func(v *verifier) {
+		v.nosumdb = patterns
+	}
+}
+
+// Verify returns a Protocol that checks every zip and go.mod of dp
+// against a checksum database, such as sum.golang.org, before
+// returning them. key is the note verifier key of the database,
+// as in GOSUMDB. Lookups verify the inclusion proof of each record
+// in the signed tree of the database, and fail if the database
+// misbehaves.
+func Verify(dp gdp.DownloadProtocol, key string, opts ...VerifyOption) (Protocol, error) {
+	nv, err := note.NewVerifier(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "checksum.newVerifier")
+	}
+	v := &verifier{
+		hasher: &hasher{dp},
+		key:    key,
+		name:   nv.Name(),
+		url:    "https://" + nv.Name(),
+		hc:     http.DefaultClient,
+		limit:  16384,
+		config: map[string][]byte{},
+	}
+	for _, o := range opts {
+		o(v)
+	}
+	v.cache = lru.New(v.limit)
+	v.db = sumdb.NewClient(v)
+	if v.nosumdb != "" {
+		v.db.SetGONOSUMDB(v.nosumdb)
+	}
+
+	return v, nil
+}
+
+// verifier implements sumdb.ClientOps, keeping the
+// latest signed tree and the tiles it reads in memory.
+type verifier struct {
+	*hasher
+	db      *sumdb.Client
+	key     string
+	name    string
+	url     string
+	hc      *http.Client
+	nosumdb string
+	limit   int
+
+	mu     sync.Mutex
+	config map[string][]byte
+	cache  *lru.Cache
+}
+
+func (v *verifier) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	bts, err := v.hasher.GoMod(ctx, module, version)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := HashGoMod(bts)
+	if err != nil {
+		return nil, errors.Wrap(err, "checksum.hashGoMod")
+	}
+	if err := v.check(ctx, module, version, "go.mod", sum); err != nil {
+		return nil, err
+	}
+
+	return bts, nil
+}
+
+// Zip spools the zip of the underlying DownloadProtocol to a temporary
+// file to hash it, and only starts returning it once it was verified.
+func (v *verifier) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
+	rdr, err := v.hasher.Zip(ctx, module, version, zipPrefix)
+	if err != nil {
+		return nil, err
+	}
+	f, err := spool(rdr)
+	gdp.CloseReader(rdr)
+	if err != nil {
+		return nil, errors.Wrap(err, "checksum.spool")
+	}
+	sum, err := hashFile(f)
+	if err == nil {
+		// the zip is of the module it claims to be in its file names.
+		if zipPrefix != "" {
+			module = zipPrefix
+		}
+		err = v.check(ctx, module, version, "zip", sum)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	// the spooled zip is removed once read or closed.
+	return autoclose.New(f, func() error {
+		f.Close()
+		return os.Remove(f.Name())
+	}), nil
+}
+
+func (v *verifier) check(ctx context.Context, module, version, file, sum string) error {
+	vers := version
+	if file == "go.mod" {
+		vers += "/go.mod"
+	}
+	lines, err := v.lookup(ctx, module, vers)
+	if err == sumdb.ErrGONOSUMDB {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "checksum.lookup")
+	}
+	prefix := module + " " + vers + " "
+	for _, line := range lines {
+		if want := strings.TrimPrefix(line, prefix); want != sum {
+			return &MismatchError{module, version, file, sum, want, v.name}
+		}
+	}
+	if len(lines) == 0 {
+		return errors.Errorf("checksum.lookup: %v has no %v hash for %v@%v", v.name, file, module, version)
+	}
+
+	return nil
+}
+
+// lookup returns when ctx is done, without waiting for the database.
+// sumdb.Client has no context of its own, so the lookup carries on
+// in the background, bounded by the timeout of ReadRemote, and the
+// tiles it reads are cached for the next one.
+func (v *verifier) lookup(ctx context.Context, module, vers string) ([]string, error) {
+	type result struct {
+		lines []string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		lines, err := v.db.Lookup(module, vers)
+		done <- result{lines, err}
+	}()
+	select {
+	case r := <-done:
+		return r.lines, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// remoteTimeout bounds every request to the checksum database,
+// since sumdb.ClientOps doesn't pass the context of the lookup.
+const remoteTimeout = time.Minute
+
+func (v *verifier) ReadRemote(path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, v.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %v%v: %v", v.url, path, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (v *verifier) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(v.key), nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.config[file], nil
+}
+
+func (v *verifier) WriteConfig(file string, old, new []byte) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if string(v.config[file]) != string(old) {
+		return sumdb.ErrWriteConflict
+	}
+	v.config[file] = new
+
+	return nil
+}
+
+func (v *verifier) ReadCache(file string) ([]byte, error) {
+	data, ok := v.cache.Get(file)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return data, nil
+}
+
+func (v *verifier) WriteCache(file string, data []byte) {
+	v.cache.Add(file, data)
+}
+
+func (v *verifier) Log(msg string) {
+	log.Print(msg)
+}
+
+// SecurityError only logs msg, the lookup that
+// caused it fails with sumdb.ErrSecurity.
+func (v *verifier) SecurityError(msg string) {
+	log.Print(msg)
+}
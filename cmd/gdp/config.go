@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/bitbucketserver"
+	"github.com/marwan-at-work/gdp/download"
+	"github.com/marwan-at-work/gdp/gitea"
+	"github.com/marwan-at-work/gdp/github"
+	"github.com/marwan-at-work/gdp/gitlab"
+	"github.com/marwan-at-work/gdp/local"
+	"github.com/marwan-at-work/gdp/upstream"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var configFile = flag.String("config", "", "json, yaml or toml configuration file, overridden by flags and GDP_ env vars")
+
+// config is the file given to -config. Most of it stands in for
+// flags, which take precedence over it, just like their GDP_ env
+// vars, such as GDP_CACHE_DIR for -cache-dir. Backends and routes
+// can only be configured in the file.
+type config struct {
+	Listen string `json:"listen" yaml:"listen" toml:"listen"`
+	// Tokens are the access tokens of github.com, bitbucket.org,
+	// gitlab.com, gitea.com and the hosts of backends.
+	Tokens   map[string]string `json:"tokens" yaml:"tokens" toml:"tokens"`
+	Backends []backend         `json:"backends" yaml:"backends" toml:"backends"`
+	Routes   []route           `json:"routes" yaml:"routes" toml:"routes"`
+	Cache    struct {
+		Type string `json:"type" yaml:"type" toml:"type"`
+		Dir  string `json:"dir" yaml:"dir" toml:"dir"`
+		TTL  string `json:"ttl" yaml:"ttl" toml:"ttl"`
+		S3   struct {
+			Endpoint string `json:"endpoint" yaml:"endpoint" toml:"endpoint"`
+			Region   string `json:"region" yaml:"region" toml:"region"`
+			Bucket   string `json:"bucket" yaml:"bucket" toml:"bucket"`
+			Prefix   string `json:"prefix" yaml:"prefix" toml:"prefix"`
+		} `json:"s3" yaml:"s3" toml:"s3"`
+	} `json:"cache" yaml:"cache" toml:"cache"`
+	SumDB struct {
+		Verify  string   `json:"verify" yaml:"verify" toml:"verify"`
+		NoSumDB string   `json:"nosumdb" yaml:"nosumdb" toml:"nosumdb"`
+		Proxy   []string `json:"proxy" yaml:"proxy" toml:"proxy"`
+		Private struct {
+			Name    string `json:"name" yaml:"name" toml:"name"`
+			Dir     string `json:"dir" yaml:"dir" toml:"dir"`
+			KeyFile string `json:"key_file" yaml:"key_file" toml:"key_file"`
+		} `json:"private" yaml:"private" toml:"private"`
+	} `json:"sumdb" yaml:"sumdb" toml:"sumdb"`
+	Upstream struct {
+		// Redirect is where requests for modules
+		// that can't be served are redirected to.
+		Redirect string `json:"redirect" yaml:"redirect" toml:"redirect"`
+		// Proxy is a GOPROXY list to fetch modules
+		// from, where direct is the code hosts.
+		Proxy string `json:"proxy" yaml:"proxy" toml:"proxy"`
+	} `json:"upstream" yaml:"upstream" toml:"upstream"`
+	Log struct {
+		Requests *bool  `json:"requests" yaml:"requests" toml:"requests"`
+		File     string `json:"file" yaml:"file" toml:"file"`
+	} `json:"log" yaml:"log" toml:"log"`
+}
+
+// backend is a code host that serves the modules under Host.
+type backend struct {
+	Name string `json:"name" yaml:"name" toml:"name"`
+	// Type is one of github, gitlab, gitea, bitbucketserver or local.
+	Type string `json:"type" yaml:"type" toml:"type"`
+	Host string `json:"host" yaml:"host" toml:"host"`
+	// URL is the base url of the code host,
+	// or the directory of the local type.
+	URL string `json:"url" yaml:"url" toml:"url"`
+	// UploadURL is the upload url of the github type,
+	// derived from URL if empty.
+	UploadURL string `json:"upload_url" yaml:"upload_url" toml:"upload_url"`
+	// Token defaults to the one of Host in Tokens.
+	Token string `json:"token" yaml:"token" toml:"token"`
+}
+
+// route sends the modules under Prefix to a backend by name.
+type route struct {
+	Prefix  string `json:"prefix" yaml:"prefix" toml:"prefix"`
+	Backend string `json:"backend" yaml:"backend" toml:"backend"`
+}
+
+// loadConfig reads the -config file, or the one in GDP_CONFIG, if
+// any. Every flag that wasn't given on the command line then takes
+// its value from its GDP_ env var, or else from the file.
+func loadConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	values := map[string]string{}
+	for name, v := range envValues(fs) {
+		if !set[name] {
+			values[name] = v
+		}
+	}
+	path := fs.Lookup("config").Value.String()
+	if path == "" {
+		path = values["config"]
+	}
+
+	cfg := &config{}
+	if path != "" {
+		if err := parseConfig(path, cfg); err != nil {
+			return nil, err
+		}
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("invalid %v: %v", path, err)
+		}
+		for name, v := range cfg.flagValues() {
+			if _, ok := values[name]; !ok && !set[name] {
+				values[name] = v
+			}
+		}
+	}
+	for name, v := range values {
+		if err := fs.Set(name, v); err != nil {
+			return nil, fmt.Errorf("invalid value %q for -%v: %v", v, name, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// envValues returns the flags that have a GDP_
+// env var, which is their upper cased name.
+func envValues(fs *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		env := "GDP_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if v, ok := os.LookupEnv(env); ok {
+			values[f.Name] = v
+		}
+	})
+
+	return values
+}
+
+func parseConfig(path string, cfg *config) error {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(bts))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(bts, cfg)
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(bts), cfg)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", md.Undecoded())
+		}
+	default:
+		return fmt.Errorf("unknown config format %q, expected .json, .yaml or .toml", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("could not parse %v: %v", path, err)
+	}
+
+	return nil
+}
+
+// validate reports every problem of the file at once.
+func (cfg *config) validate() error {
+	var errs []string
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+	names := map[string]bool{}
+	for i, b := range cfg.Backends {
+		if b.Name == "" {
+			fail("backends[%v]: missing name", i)
+		} else if names[b.Name] {
+			fail("backends[%v]: duplicate name %q", i, b.Name)
+		}
+		names[b.Name] = true
+		if b.Host == "" {
+			fail("backend %q: missing host", b.Name)
+		}
+		switch b.Type {
+		case "github":
+			if _, err := github.NewEnterprise(b.URL, b.UploadURL, ""); err != nil {
+				fail("backend %q: invalid url: %v", b.Name, err)
+			}
+		case "gitlab", "gitea", "bitbucketserver":
+			if u, err := url.Parse(b.URL); err != nil || u.Host == "" {
+				fail("backend %q: invalid url %q", b.Name, b.URL)
+			}
+		case "local":
+			if b.URL == "" {
+				fail("backend %q: missing url, the directory of its repositories", b.Name)
+			}
+		default:
+			fail("backend %q: unknown type %q, expected github, gitlab, gitea, bitbucketserver or local", b.Name, b.Type)
+		}
+	}
+	for i, r := range cfg.Routes {
+		if r.Prefix == "" {
+			fail("routes[%v]: missing prefix", i)
+		}
+		if !names[r.Backend] {
+			fail("routes[%v]: unknown backend %q", i, r.Backend)
+		}
+	}
+	switch cfg.Cache.Type {
+	case "", "memory", "disk":
+	case "s3":
+		if cfg.Cache.S3.Bucket == "" {
+			fail("cache: missing s3 bucket")
+		}
+	default:
+		fail("cache: unknown type %q, expected memory, disk or s3", cfg.Cache.Type)
+	}
+	if cfg.Cache.TTL != "" {
+		if _, err := time.ParseDuration(cfg.Cache.TTL); err != nil {
+			fail("cache: invalid ttl: %v", err)
+		}
+	}
+	if cfg.Upstream.Redirect != "" {
+		if u, err := url.Parse(cfg.Upstream.Redirect); err != nil || u.Host == "" {
+			fail("upstream: invalid redirect %q", cfg.Upstream.Redirect)
+		}
+	}
+	if cfg.Upstream.Proxy != "" {
+		if _, err := upstream.New(cfg.Upstream.Proxy, gdp.NoOpProtocol()); err != nil {
+			fail("upstream: invalid proxy: %v", err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// flagValues returns the flags that the file sets.
+func (cfg *config) flagValues() map[string]string {
+	values := map[string]string{}
+	setIf := func(name, v string) {
+		if v != "" {
+			values[name] = v
+		}
+	}
+	setIf("listen", cfg.Listen)
+	setIf("token", cfg.Tokens["github.com"])
+	setIf("bitbucket-token", cfg.Tokens["bitbucket.org"])
+	setIf("redirect", cfg.Upstream.Redirect)
+	setIf("upstream", cfg.Upstream.Proxy)
+	setIf("cache", cfg.Cache.Type)
+	setIf("cache-dir", cfg.Cache.Dir)
+	setIf("cache-ttl", cfg.Cache.TTL)
+	setIf("cache-s3-endpoint", cfg.Cache.S3.Endpoint)
+	setIf("cache-s3-region", cfg.Cache.S3.Region)
+	setIf("cache-s3-bucket", cfg.Cache.S3.Bucket)
+	setIf("cache-s3-prefix", cfg.Cache.S3.Prefix)
+	setIf("verify-sumdb", cfg.SumDB.Verify)
+	setIf("nosumdb", cfg.SumDB.NoSumDB)
+	setIf("proxy-sumdb", strings.Join(cfg.SumDB.Proxy, ","))
+	setIf("private-sumdb", cfg.SumDB.Private.Name)
+	setIf("private-sumdb-dir", cfg.SumDB.Private.Dir)
+	setIf("private-sumdb-key", cfg.SumDB.Private.KeyFile)
+	setIf("log-file", cfg.Log.File)
+	if cfg.Log.Requests != nil {
+		values["log-requests"] = strconv.FormatBool(*cfg.Log.Requests)
+	}
+
+	return values
+}
+
+// downloadOptions routes the hosts of backends to them, then
+// the prefixes of routes, and the default hosts to their tokens.
+func (cfg *config) downloadOptions() []download.Option {
+	var opts []download.Option
+	protos := map[string]gdp.DownloadProtocol{}
+	for _, b := range cfg.Backends {
+		tok := b.Token
+		if tok == "" {
+			tok = cfg.Tokens[b.Host]
+		}
+		var ch gdp.CodeHost
+		switch b.Type {
+		case "github":
+			// validate made sure that the urls are valid.
+			ch, _ = github.NewEnterprise(b.URL, b.UploadURL, tok)
+		case "gitlab":
+			ch = gitlab.New(b.URL, tok)
+		case "gitea":
+			ch = gitea.New(b.URL, tok)
+		case "bitbucketserver":
+			ch = bitbucketserver.New(b.URL, tok)
+		case "local":
+			ch = local.New(b.URL)
+		}
+		protos[b.Name] = gdp.New(ch)
+		opts = append(opts, download.WithRoute(b.Host, protos[b.Name]))
+	}
+	for _, r := range cfg.Routes {
+		opts = append(opts, download.WithRoute(r.Prefix, protos[r.Backend]))
+	}
+	if tok := cfg.Tokens["gitlab.com"]; tok != "" {
+		opts = append(opts, download.WithGitLab("gitlab.com", "", tok))
+	}
+	if tok := cfg.Tokens["gitea.com"]; tok != "" {
+		opts = append(opts, download.WithGitea("gitea.com", "https://gitea.com", tok))
+	}
+
+	return opts
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFlags() (*flag.FlagSet, map[string]*string) {
+	fs := flag.NewFlagSet("gdp", flag.ContinueOnError)
+	fs.String("config", "", "")
+	vals := map[string]*string{}
+	for _, name := range []string{"listen", "token", "cache", "redirect", "upstream", "proxy-sumdb"} {
+		vals[name] = fs.String(name, "", "")
+	}
+	fs.Duration("cache-ttl", time.Minute, "")
+	fs.Bool("log-requests", true, "")
+
+	return fs, vals
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func TestLoadConfig(t *testing.T) {
+	for name, content := range map[string]string{
+		"gdp.json": `{
+			"listen": ":9090",
+			"tokens": {"github.com": "ghtok"},
+			"backends": [{"name": "corp", "type": "gitlab", "host": "gitlab.mycorp.com", "url": "https://gitlab.mycorp.com"}],
+			"routes": [{"prefix": "go.mycorp.com", "backend": "corp"}],
+			"cache": {"type": "memory", "ttl": "5m"},
+			"sumdb": {"proxy": ["sum.golang.org", "sum.mycorp.com=https://sum.mycorp.com"]},
+			"log": {"requests": false}
+		}`,
+		"gdp.yaml": `
+listen: ":9090"
+tokens:
+  github.com: ghtok
+backends:
+  - name: corp
+    type: gitlab
+    host: gitlab.mycorp.com
+    url: https://gitlab.mycorp.com
+routes:
+  - prefix: go.mycorp.com
+    backend: corp
+cache:
+  type: memory
+  ttl: 5m
+sumdb:
+  proxy: [sum.golang.org, "sum.mycorp.com=https://sum.mycorp.com"]
+log:
+  requests: false
+`,
+		"gdp.toml": `
+listen = ":9090"
+
+[tokens]
+"github.com" = "ghtok"
+
+[[backends]]
+name = "corp"
+type = "gitlab"
+host = "gitlab.mycorp.com"
+url = "https://gitlab.mycorp.com"
+
+[[routes]]
+prefix = "go.mycorp.com"
+backend = "corp"
+
+[cache]
+type = "memory"
+ttl = "5m"
+
+[sumdb]
+proxy = ["sum.golang.org", "sum.mycorp.com=https://sum.mycorp.com"]
+
+[log]
+requests = false
+`,
+	} {
+		fs, vals := testFlags()
+		cfg, err := loadConfig(fs, []string{"-config", writeConfig(t, name, content), "-cache", "disk"})
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if *vals["listen"] != ":9090" || *vals["token"] != "ghtok" {
+			t.Fatalf("%v: unexpected flags %v %v", name, *vals["listen"], *vals["token"])
+		}
+		if *vals["proxy-sumdb"] != "sum.golang.org,sum.mycorp.com=https://sum.mycorp.com" {
+			t.Fatalf("%v: unexpected -proxy-sumdb %v", name, *vals["proxy-sumdb"])
+		}
+		if fs.Lookup("cache-ttl").Value.String() != "5m0s" || fs.Lookup("log-requests").Value.String() != "false" {
+			t.Fatalf("%v: unexpected flags", name)
+		}
+		// flags take precedence.
+		if *vals["cache"] != "disk" {
+			t.Fatalf("%v: expected -cache to override the file but got %v", name, *vals["cache"])
+		}
+		if len(cfg.Backends) != 1 || len(cfg.Routes) != 1 || len(cfg.downloadOptions()) != 2 {
+			t.Fatalf("%v: unexpected backends %+v and routes %+v", name, cfg.Backends, cfg.Routes)
+		}
+	}
+}
+
+func TestLoadConfigEnv(t *testing.T) {
+	p := writeConfig(t, "gdp.json", `{"listen": ":9090", "upstream": {"redirect": "https://proxy.golang.org", "proxy": "direct,https://proxy.golang.org"}}`)
+	os.Setenv("GDP_CONFIG", p)
+	os.Setenv("GDP_LISTEN", ":7070")
+	defer os.Unsetenv("GDP_CONFIG")
+	defer os.Unsetenv("GDP_LISTEN")
+
+	fs, vals := testFlags()
+	if _, err := loadConfig(fs, nil); err != nil {
+		t.Fatal(err)
+	}
+	if *vals["listen"] != ":7070" || *vals["redirect"] != "https://proxy.golang.org" {
+		t.Fatalf("unexpected flags %v %v", *vals["listen"], *vals["redirect"])
+	}
+	if *vals["upstream"] != "direct,https://proxy.golang.org" {
+		t.Fatalf("unexpected -upstream %v", *vals["upstream"])
+	}
+
+	fs, vals = testFlags()
+	if _, err := loadConfig(fs, []string{"-listen", ":6060"}); err != nil {
+		t.Fatal(err)
+	}
+	if *vals["listen"] != ":6060" {
+		t.Fatalf("expected -listen to override GDP_LISTEN but got %v", *vals["listen"])
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	p := writeConfig(t, "gdp.yaml", `
+backends:
+  - name: corp
+    type: svn
+    host: svn.mycorp.com
+  - name: corp
+    type: gitea
+    host: gitea.mycorp.com
+    url: not a url
+  - name: ghe
+    type: github
+    host: github.mycorp.com
+    url: github.mycorp.com
+routes:
+  - prefix: go.mycorp.com
+    backend: nope
+cache:
+  type: s3
+  ttl: forever
+upstream:
+  proxy: https://proxy.golang.org,ftp://athens.mycorp.com
+`)
+	fs, _ := testFlags()
+	_, err := loadConfig(fs, []string{"-config", p})
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, msg := range []string{
+		`unknown type "svn"`,
+		`duplicate name "corp"`,
+		`invalid url "not a url"`,
+		`backend "ghe": invalid url`,
+		`unknown backend "nope"`,
+		"missing s3 bucket",
+		"invalid ttl",
+		"upstream: invalid proxy",
+	} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("expected %q in %v", msg, err)
+		}
+	}
+
+	p = writeConfig(t, "gdp.yaml", "lisen: \":9090\"\n")
+	fs, _ = testFlags()
+	if _, err := loadConfig(fs, []string{"-config", p}); err == nil {
+		t.Fatal("expected an error for an unknown key")
+	}
+}
@@ -5,12 +5,26 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/bitbucket"
+	"github.com/marwan-at-work/gdp/cache"
+	"github.com/marwan-at-work/gdp/cache/s3"
+	"github.com/marwan-at-work/gdp/checksum"
+	"github.com/marwan-at-work/gdp/coalesce"
 	"github.com/marwan-at-work/gdp/download"
+	"github.com/marwan-at-work/gdp/sumdb"
+	"github.com/marwan-at-work/gdp/upstream"
+	"github.com/pkg/errors"
 )
 
 const pathList = "/{module:.+}/@v/list"
@@ -18,34 +32,90 @@ const pathVersionModule = "/{module:.+}/@v/{version}.mod"
 const pathVersionInfo = "/{module:.+}/@v/{version}.info"
 const pathLatest = "/{module:.+}/@latest"
 const pathVersionZip = "/{module:.+}/@v/{version}.zip"
+const pathVersionSum = "/{module:.+}/@v/{version}.sum"
 
+var listen = flag.String("listen", ":8090", "address to listen on")
+var logRequests = flag.Bool("log-requests", true, "log every request")
+var logFile = flag.String("log-file", "", "file to log to instead of stdout")
 var token = flag.String("token", "", "github token against rate limiting")
 var redirect = flag.String("redirect", "", "redirect instead of 404")
+var upstreamProxy = flag.String("upstream", "", "fetch modules from GOPROXY servers, comma or pipe separated as in GOPROXY, where direct is the code hosts")
+var githubURL = flag.String("github-url", "", "base url of a github enterprise server instance")
+var githubUploadURL = flag.String("github-upload-url", "", "upload url of -github-url, derived from it if empty")
+var githubToken = flag.String("github-token", "", "github enterprise token for -github-url")
+var gitlabURL = flag.String("gitlab-url", "", "base url of a self-hosted gitlab instance")
+var gitlabToken = flag.String("gitlab-token", "", "gitlab private token, for -gitlab-url if set or else gitlab.com")
+var giteaURL = flag.String("gitea-url", "", "base url of a self-hosted gitea or forgejo instance")
+var giteaToken = flag.String("gitea-token", "", "gitea access token, for -gitea-url if set or else gitea.com")
+var bitbucketUser = flag.String("bitbucket-user", "", "bitbucket.org user of -bitbucket-app-password")
+var bitbucketAppPassword = flag.String("bitbucket-app-password", "", "bitbucket.org app password for private repositories")
+var bitbucketToken = flag.String("bitbucket-token", "", "bitbucket.org oauth or access token, instead of an app password")
+var bitbucketServerURL = flag.String("bitbucket-server-url", "", "base url of a bitbucket server or data center instance")
+var bitbucketServerToken = flag.String("bitbucket-server-token", "", "bitbucket server personal access token for -bitbucket-server-url")
+var localRepos = flag.String("local", "", "serve host from git repositories on disk, as host=dir")
+var verifySumDB = flag.String("verify-sumdb", "", "verify zips and go.mod files against a checksum database, as in GOSUMDB")
+var proxySumDB = flag.String("proxy-sumdb", "", "comma separated checksum databases to proxy, as name or name=url")
+var privateSumDB = flag.String("private-sumdb", "", "name of a checksum database of the modules served, such as sum.mycorp.com")
+var privateSumDBDir = flag.String("private-sumdb-dir", "sumdb", "directory of the -private-sumdb log and generated key")
+var privateSumDBKey = flag.String("private-sumdb-key", "", "file with the note signer key of -private-sumdb, generated if empty")
+var noSumDB = flag.String("nosumdb", "", "comma separated module path prefixes not to verify, as in GONOSUMDB")
+var cacheType = flag.String("cache", "", "cache modules in memory, on disk or in s3")
+var cacheDir = flag.String("cache-dir", "cache", "directory of the disk -cache, laid out like a GOPROXY")
+var cacheTTL = flag.Duration("cache-ttl", time.Minute, "how long the -cache keeps version lists and latest versions")
+var cacheS3Endpoint = flag.String("cache-s3-endpoint", "https://s3.amazonaws.com", "base url of the s3 compatible object store of the s3 -cache")
+var cacheS3Region = flag.String("cache-s3-region", "us-east-1", "region of the s3 -cache")
+var cacheS3Bucket = flag.String("cache-s3-bucket", "", "bucket of the s3 -cache, with credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+var cacheS3Prefix = flag.String("cache-s3-prefix", "", "prefix of the objects of the s3 -cache")
+
+// sumGolangOrg is the key of sum.golang.org, which is the
+// one -verify-sumdb uses when given just its name.
+const sumGolangOrg = "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ti18htE+9ARF5+u5ZMSUA5"
 
 func getRedirectURL(path string) string {
 	return strings.TrimSuffix(*redirect, "/") + "/" + strings.TrimPrefix(path, "/")
 }
 
+// logOut is where requests and errors are logged.
+var logOut io.Writer = os.Stdout
+
 func main() {
-	flag.Parse()
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		logOut = f
+	}
 	r := mux.NewRouter()
-	dp := download.New(*token)
+	dp := protocol(cfg)
+	if *privateSumDB != "" {
+		p := privateDB(dp)
+		// cmd/go reaches the database through its GOPROXY.
+		fmt.Fprintf(logOut, "serving %v, set GOSUMDB=%v\n", p.Name(), p.VerifierKey())
+		r.PathPrefix("/sumdb/" + p.Name() + "/").Handler(p)
+	}
+	r.PathPrefix("/sumdb/").Handler(sumdb.NewProxy(sumdbUpstreams()))
 	r.HandleFunc(pathList, func(w http.ResponseWriter, r *http.Request) {
 		module, err := getModule(r)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(400)
 			return
 		}
 
 		vers, err := dp.List(r.Context(), module)
 		if err != nil {
-			sc := statusErr(err)
+			sc := statusErr(w, err)
 			if sc == 404 && *redirect != "" {
 				http.Redirect(w, r, getRedirectURL(r.URL.Path), http.StatusMovedPermanently)
 				return
 			}
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(sc)
 			return
 		}
@@ -56,18 +126,18 @@ func main() {
 	r.HandleFunc(pathVersionModule, func(w http.ResponseWriter, r *http.Request) {
 		module, ver, err := modAndVersion(r)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(400)
 			return
 		}
 		bts, err := dp.GoMod(r.Context(), module, ver)
 		if err != nil {
-			sc := statusErr(err)
+			sc := statusErr(w, err)
 			if sc == 404 && *redirect != "" {
 				http.Redirect(w, r, getRedirectURL(r.URL.Path), http.StatusMovedPermanently)
 				return
 			}
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(sc)
 			return
 		}
@@ -78,18 +148,18 @@ func main() {
 	r.HandleFunc(pathVersionInfo, func(w http.ResponseWriter, r *http.Request) {
 		module, ver, err := modAndVersion(r)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(400)
 			return
 		}
 		info, err := dp.Info(r.Context(), module, ver)
 		if err != nil {
-			sc := statusErr(err)
+			sc := statusErr(w, err)
 			if sc == 404 && *redirect != "" {
 				http.Redirect(w, r, getRedirectURL(r.URL.Path), http.StatusMovedPermanently)
 				return
 			}
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(sc)
 			return
 		}
@@ -100,19 +170,19 @@ func main() {
 	r.HandleFunc(pathLatest, func(w http.ResponseWriter, r *http.Request) {
 		module, err := getModule(r)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(400)
 			return
 		}
 
 		info, err := dp.Latest(r.Context(), module)
 		if err != nil {
-			sc := statusErr(err)
+			sc := statusErr(w, err)
 			if sc == 404 && *redirect != "" {
 				http.Redirect(w, r, getRedirectURL(r.URL.Path), http.StatusMovedPermanently)
 				return
 			}
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(sc)
 			return
 		}
@@ -123,39 +193,219 @@ func main() {
 	r.HandleFunc(pathVersionZip, func(w http.ResponseWriter, r *http.Request) {
 		module, ver, err := modAndVersion(r)
 		if err != nil {
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(400)
 			return
 		}
 		rdr, err := dp.Zip(r.Context(), module, ver, "")
 		if err != nil {
-			sc := statusErr(err)
+			sc := statusErr(w, err)
 			if sc == 404 && *redirect != "" {
 				http.Redirect(w, r, getRedirectURL(r.URL.Path), http.StatusMovedPermanently)
 				return
 			}
-			fmt.Println(err)
+			fmt.Fprintln(logOut, err)
 			w.WriteHeader(sc)
 			return
 		}
 
-		io.Copy(w, rdr)
+		defer gdp.CloseReader(rdr)
+		// the status is already sent, so a failed
+		// copy, such as a client going away, is logged.
+		if _, err := io.Copy(w, rdr); err != nil {
+			fmt.Fprintln(logOut, err)
+		}
 	})
 
-	r.Use(func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			fmt.Println(r.Method, r.URL.String())
-			h.ServeHTTP(w, r)
-		})
+	// pathVersionSum is not part of the download protocol. It serves the
+	// go.sum lines of the zip and go.mod above, to compare them against
+	// what sum.golang.org recorded.
+	r.HandleFunc(pathVersionSum, func(w http.ResponseWriter, r *http.Request) {
+		module, ver, err := modAndVersion(r)
+		if err != nil {
+			fmt.Fprintln(logOut, err)
+			w.WriteHeader(400)
+			return
+		}
+		sums, err := dp.Sum(r.Context(), module, ver)
+		if err != nil {
+			fmt.Fprintln(logOut, err)
+			w.WriteHeader(statusErr(w, err))
+			return
+		}
+
+		fmt.Fprint(w, sums.GoSum(module, ver))
 	})
 
+	if *logRequests {
+		r.Use(func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprintln(logOut, r.Method, r.URL.String())
+				h.ServeHTTP(w, r)
+			})
+		})
+	}
+
 	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("NOT FOUND", r.URL.String())
+		fmt.Fprintln(logOut, "NOT FOUND", r.URL.String())
 
 		w.WriteHeader(http.StatusNotFound)
 	})
 
-	http.ListenAndServe(":8090", r)
+	log.Fatal(http.ListenAndServe(*listen, r))
+}
+
+// protocol verifies what's downloaded before
+// caching it, so that the cache is trusted, and
+// coalesces concurrent requests for the same module
+// in front of the cache, so that a miss is fetched
+// and put in the cache once.
+func protocol(cfg *config) checksum.Protocol {
+	// flags take precedence over the config file.
+	opts := append(cfg.downloadOptions(), downloadOptions()...)
+	var dp gdp.DownloadProtocol = download.New(*token, opts...)
+	if *upstreamProxy != "" {
+		// upstream modules go through the
+		// same verification and cache.
+		up, err := upstream.New(*upstreamProxy, dp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		dp = up
+	}
+	if *verifySumDB != "" {
+		dp = verify(dp)
+	}
+	switch *cacheType {
+	case "":
+	case "memory":
+		dp = cache.New(dp, cache.NewMemory(), *cacheTTL)
+	case "disk":
+		dp = cache.New(dp, cache.NewDisk(*cacheDir), *cacheTTL)
+	case "s3":
+		if *cacheS3Bucket == "" {
+			log.Fatal("-cache s3 needs a -cache-s3-bucket")
+		}
+		dp = cache.New(dp, s3.New(s3.Config{
+			Endpoint:        *cacheS3Endpoint,
+			Region:          *cacheS3Region,
+			Bucket:          *cacheS3Bucket,
+			Prefix:          *cacheS3Prefix,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}), *cacheTTL)
+	default:
+		log.Fatalf("invalid -cache %q, expected memory, disk or s3", *cacheType)
+	}
+
+	return checksum.New(coalesce.New(dp))
+}
+
+func verify(dp gdp.DownloadProtocol) gdp.DownloadProtocol {
+	// like GOSUMDB, the flag is a key and an optional url.
+	fields := strings.Fields(*verifySumDB)
+	key := fields[0]
+	if key == "sum.golang.org" {
+		key = sumGolangOrg
+	}
+	opts := []checksum.VerifyOption{checksum.WithNoSumDB(*noSumDB)}
+	if len(fields) > 1 {
+		opts = append(opts, checksum.WithURL(fields[1]))
+	}
+	v, err := checksum.Verify(dp, key, opts...)
+	if err != nil {
+		log.Fatalf("invalid -verify-sumdb %q: %v", *verifySumDB, err)
+	}
+
+	return v
+}
+
+func privateDB(dp checksum.Protocol) *sumdb.Private {
+	var skey string
+	var err error
+	if *privateSumDBKey != "" {
+		var bts []byte
+		bts, err = ioutil.ReadFile(*privateSumDBKey)
+		skey = strings.TrimSpace(string(bts))
+	} else {
+		skey, err = sumdb.GenerateKey(*privateSumDBDir, *privateSumDB)
+	}
+	if err != nil {
+		log.Fatalf("could not read -private-sumdb key: %v", err)
+	}
+	p, err := sumdb.NewPrivate(*privateSumDBDir, skey, dp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if p.Name() != *privateSumDB {
+		log.Fatalf("-private-sumdb-key is for %v, not %v", p.Name(), *privateSumDB)
+	}
+
+	return p
+}
+
+// sumdbUpstreams parses -proxy-sumdb, where a name
+// alone stands for the database at https://name.
+func sumdbUpstreams() map[string]string {
+	if *proxySumDB == "" {
+		return nil
+	}
+	upstreams := map[string]string{}
+	for _, db := range strings.Split(*proxySumDB, ",") {
+		kv := strings.SplitN(db, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "https://"+kv[0])
+		}
+		upstreams[kv[0]] = kv[1]
+	}
+
+	return upstreams
+}
+
+func downloadOptions() []download.Option {
+	var opts []download.Option
+	if *githubURL != "" {
+		opts = append(opts, download.WithGitHubEnterprise(hostOf("github-url", *githubURL), *githubURL, *githubUploadURL, *githubToken))
+	}
+	switch {
+	case *gitlabURL != "":
+		opts = append(opts, download.WithGitLab(hostOf("gitlab-url", *gitlabURL), *gitlabURL, *gitlabToken))
+	case *gitlabToken != "":
+		opts = append(opts, download.WithGitLab("gitlab.com", "", *gitlabToken))
+	}
+	switch {
+	case *giteaURL != "":
+		opts = append(opts, download.WithGitea(hostOf("gitea-url", *giteaURL), *giteaURL, *giteaToken))
+	case *giteaToken != "":
+		opts = append(opts, download.WithGitea("gitea.com", "https://gitea.com", *giteaToken))
+	}
+	switch {
+	case *bitbucketAppPassword != "":
+		opts = append(opts, download.WithBitbucket(bitbucket.WithAppPassword(*bitbucketUser, *bitbucketAppPassword)))
+	case *bitbucketToken != "":
+		opts = append(opts, download.WithBitbucket(bitbucket.WithOAuthToken(*bitbucketToken)))
+	}
+	if *bitbucketServerURL != "" {
+		opts = append(opts, download.WithBitbucketServer(hostOf("bitbucket-server-url", *bitbucketServerURL), *bitbucketServerURL, *bitbucketServerToken))
+	}
+	if *localRepos != "" {
+		kv := strings.SplitN(*localRepos, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			log.Fatalf("invalid -local %q, expected host=dir", *localRepos)
+		}
+		opts = append(opts, download.WithLocal(kv[0], kv[1]))
+	}
+
+	return opts
+}
+
+func hostOf(flagName, rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		log.Fatalf("invalid -%v %q", flagName, rawurl)
+	}
+
+	return u.Host
 }
 
 func getModule(r *http.Request) (string, error) {
@@ -190,10 +440,28 @@ func modAndVersion(r *http.Request) (mod, ver string, err error) {
 	return mod, ver, nil
 }
 
-func statusErr(err error) int {
-	if err == gdp.ErrNotFound {
-		return 404
+// statusErr returns the status code of the kind of err, and
+// tells the client when to retry a rate limited request.
+func statusErr(w http.ResponseWriter, err error) int {
+	switch {
+	case errors.Is(err, gdp.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, gdp.ErrGone):
+		return http.StatusGone
+	case errors.Is(err, gdp.ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, gdp.ErrRateLimited):
+		var rle *gdp.RateLimitError
+		if errors.As(err, &rle) && rle.RetryAfter > 0 {
+			secs := int((rle.RetryAfter + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+		}
+		return http.StatusTooManyRequests
+	case errors.Is(err, gdp.ErrInvalidVersion):
+		return http.StatusBadRequest
+	case errors.Is(err, gdp.ErrUnavailable):
+		return http.StatusBadGateway
 	}
 
-	return 500
+	return http.StatusInternalServerError
 }
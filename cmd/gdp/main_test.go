@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+)
+
+func TestStatusErr(t *testing.T) {
+	for err, expected := range map[error]int{
+		gdp.ErrNotFound:                          404,
+		errors.Wrap(gdp.ErrNotFound, "wrapped"):  404,
+		errors.Wrap(gdp.ErrGone, "wrapped"):      410,
+		errors.Wrap(gdp.ErrUnauthorized, "auth"): 401,
+		gdp.ErrInvalidVersion:                    400,
+		gdp.Unavailable(errors.New("timeout")):   502,
+		errors.New("boom"):                       500,
+	} {
+		if sc := statusErr(httptest.NewRecorder(), err); sc != expected {
+			t.Fatalf("expected %v for %v but got %v", expected, err, sc)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	err := errors.Wrap(&gdp.RateLimitError{RetryAfter: 1500 * time.Millisecond}, "wrapped")
+	if sc := statusErr(w, err); sc != 429 || w.Header().Get("Retry-After") != "2" {
+		t.Fatalf("unexpected status %v and Retry-After %q", sc, w.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,237 @@
+// Package coalesce wraps a gdp.DownloadProtocol so that concurrent
+// identical requests share a single call to it, like when a CI run
+// fans out jobs that all ask for the same module at once.
+package coalesce
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/internal/autoclose"
+	"github.com/pkg/errors"
+)
+
+// Option configures the DownloadProtocol returned by New.
+type Option func(*coalescer)
+
+// WithTimeout bounds how long a shared call may take, 10
+// minutes by default, so that a hung upstream doesn't keep
+// every later caller of the same module waiting for good.
+func WithTimeout(d time.Duration) Option {
+	return func(c *coalescer) {
+		c.timeout = d
+	}
+}
+
+// New returns a DownloadProtocol that coalesces concurrent calls
+// to dp with the same method, module and version. Zips are spooled
+// to a temporary file that every caller reads on its own, and that
+// is removed once they all read it to the end or close it.
+//
+// The shared call isn't canceled when the caller that started it
+// goes away, since others may still be waiting for it, but every
+// caller stops waiting when its own context is done.
+func New(dp gdp.DownloadProtocol, opts ...Option) gdp.DownloadProtocol {
+	c := &coalescer{dp: dp, timeout: 10 * time.Minute, calls: map[string]*call{}}
+	for _, o := range opts {
+		o(c)
+	}
+
+	return c
+}
+
+type coalescer struct {
+	dp      gdp.DownloadProtocol
+	timeout time.Duration
+
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// call is a call to dp in flight, or done
+// if it's no longer in coalescer.calls.
+type call struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+}
+
+// releaser is a result that each
+// waiter must let go of when done.
+type releaser interface {
+	release()
+}
+
+func (c *coalescer) do(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	c.mu.Lock()
+	cl, ok := c.calls[key]
+	if !ok {
+		cl = &call{done: make(chan struct{})}
+		c.calls[key] = cl
+		go c.run(key, cl, detached{ctx}, fn)
+	}
+	cl.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-cl.done:
+		return cl.val, cl.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.calls[key] == cl {
+			cl.waiters--
+			return nil, ctx.Err()
+		}
+		// the call finished in the meantime and
+		// counted this waiter in its result.
+		if r, ok := cl.val.(releaser); ok {
+			r.release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (c *coalescer) run(key string, cl *call, ctx context.Context, fn func(context.Context) (interface{}, error)) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	val, err := fn(ctx)
+	cancel()
+	c.mu.Lock()
+	delete(c.calls, key)
+	if z, ok := val.(*spooled); ok {
+		z.refs = cl.waiters
+		if z.refs == 0 {
+			z.remove()
+		}
+	}
+	cl.val, cl.err = val, err
+	c.mu.Unlock()
+	close(cl.done)
+}
+
+func (c *coalescer) List(ctx context.Context, module string) ([]string, error) {
+	val, err := c.do(ctx, "list\x00"+module, func(ctx context.Context) (interface{}, error) {
+		return c.dp.List(ctx, module)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string(nil), val.([]string)...), nil
+}
+
+func (c *coalescer) Info(ctx context.Context, module, version string) (*gdp.RevInfo, error) {
+	val, err := c.do(ctx, "info\x00"+module+"\x00"+version, func(ctx context.Context) (interface{}, error) {
+		return c.dp.Info(ctx, module, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := *val.(*gdp.RevInfo)
+
+	return &info, nil
+}
+
+func (c *coalescer) Latest(ctx context.Context, module string) (*gdp.RevInfo, error) {
+	val, err := c.do(ctx, "latest\x00"+module, func(ctx context.Context) (interface{}, error) {
+		return c.dp.Latest(ctx, module)
+	})
+	if err != nil {
+		return nil, err
+	}
+	info := *val.(*gdp.RevInfo)
+
+	return &info, nil
+}
+
+func (c *coalescer) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	val, err := c.do(ctx, "mod\x00"+module+"\x00"+version, func(ctx context.Context) (interface{}, error) {
+		return c.dp.GoMod(ctx, module, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), val.([]byte)...), nil
+}
+
+func (c *coalescer) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
+	key := "zip\x00" + module + "\x00" + version + "\x00" + zipPrefix
+	val, err := c.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		rdr, err := c.dp.Zip(ctx, module, version, zipPrefix)
+		if err != nil {
+			return nil, err
+		}
+		z, err := spool(rdr)
+		gdp.CloseReader(rdr)
+		if err != nil {
+			return nil, err
+		}
+		return z, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	z := val.(*spooled)
+
+	// the spooled zip is released once every reader is done with it.
+	return autoclose.New(io.NewSectionReader(z.f, 0, z.size), func() error {
+		z.release()
+		return nil
+	}), nil
+}
+
+// spooled is a zip in a temporary file, shared by refs readers.
+type spooled struct {
+	f    *os.File
+	size int64
+	refs int // guarded by coalescer.mu, until it's handed out
+	mu   sync.Mutex
+}
+
+func spool(r io.Reader) (*spooled, error) {
+	f, err := ioutil.TempFile("", "gdp-coalesce")
+	if err != nil {
+		return nil, errors.Wrap(err, "coalesce.tempFile")
+	}
+	size, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "coalesce.spool")
+	}
+
+	return &spooled{f: f, size: size}, nil
+}
+
+func (z *spooled) release() {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.refs--
+	if z.refs == 0 {
+		z.remove()
+	}
+}
+
+func (z *spooled) remove() {
+	z.f.Close()
+	os.Remove(z.f.Name())
+}
+
+// detached keeps the values of a context but not its
+// cancellation, so that a shared call isn't canceled
+// by the caller that happened to start it. run puts
+// a timeout of its own on it.
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
@@ -0,0 +1,177 @@
+package coalesce
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+)
+
+// slowProtocol blocks every call until release is closed.
+type slowProtocol struct {
+	gdp.DownloadProtocol
+	release chan struct{}
+	zips    int32
+	mods    int32
+}
+
+func (s *slowProtocol) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	atomic.AddInt32(&s.mods, 1)
+	<-s.release
+	return []byte("module " + module + "\n"), nil
+}
+
+func (s *slowProtocol) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
+	atomic.AddInt32(&s.zips, 1)
+	<-s.release
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return strings.NewReader("zip of " + module + "@" + version), nil
+}
+
+// waitFor blocks until key has n waiters.
+func waitFor(t *testing.T, c *coalescer, key string, n int) {
+	t.Helper()
+	for i := 0; i < 1000; i++ {
+		c.mu.Lock()
+		cl, ok := c.calls[key]
+		waiting := ok && cl.waiters == n
+		c.mu.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%q never got %v waiters", key, n)
+}
+
+func TestZip(t *testing.T) {
+	up := &slowProtocol{release: make(chan struct{})}
+	c := New(up).(*coalescer)
+
+	// the first caller goes away, which
+	// doesn't cancel the call for the rest.
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Zip(ctx, "github.com/owner/repo", "v1.0.0", "")
+		errs <- err
+	}()
+	key := "zip\x00github.com/owner/repo\x00v1.0.0\x00"
+	waitFor(t, c, key, 1)
+
+	const n = 50
+	var wg sync.WaitGroup
+	zips := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rdr, err := c.Zip(context.Background(), "github.com/owner/repo", "v1.0.0", "")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			bts, _ := ioutil.ReadAll(rdr)
+			zips[i] = string(bts)
+		}(i)
+	}
+	waitFor(t, c, key, n+1)
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected the canceled caller to stop waiting but got %v", err)
+	}
+	close(up.release)
+	wg.Wait()
+
+	if up.zips != 1 {
+		t.Fatalf("expected a single upstream call but got %v", up.zips)
+	}
+	for _, z := range zips {
+		if z != "zip of github.com/owner/repo@v1.0.0" {
+			t.Fatalf("unexpected zip %q", z)
+		}
+	}
+
+	// later calls aren't coalesced with finished ones.
+	rdr, err := c.Zip(context.Background(), "github.com/owner/repo", "v1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(rdr)
+	if up.zips != 2 {
+		t.Fatalf("expected a second upstream call but got %v", up.zips)
+	}
+}
+
+func TestGoMod(t *testing.T) {
+	up := &slowProtocol{release: make(chan struct{})}
+	c := New(up).(*coalescer)
+
+	var wg sync.WaitGroup
+	for _, version := range []string{"v1.0.0", "v1.0.0", "v1.1.0"} {
+		wg.Add(1)
+		go func(version string) {
+			defer wg.Done()
+			mod, err := c.GoMod(context.Background(), "github.com/owner/repo", version)
+			if err != nil || string(mod) != "module github.com/owner/repo\n" {
+				t.Errorf("unexpected go.mod %s: %v", mod, err)
+			}
+		}(version)
+	}
+	waitFor(t, c, "mod\x00github.com/owner/repo\x00v1.0.0", 2)
+	waitFor(t, c, "mod\x00github.com/owner/repo\x00v1.1.0", 1)
+	close(up.release)
+	wg.Wait()
+	if up.mods != 2 {
+		t.Fatalf("expected an upstream call per version but got %v", up.mods)
+	}
+}
+
+func TestZipClose(t *testing.T) {
+	up := &slowProtocol{release: make(chan struct{})}
+	close(up.release)
+	c := New(up)
+	tmp, err := ioutil.TempDir("", "coalesce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	rdr, err := c.Zip(context.Background(), "github.com/owner/repo", "v1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdr.Read(make([]byte, 1))
+	gdp.CloseReader(rdr)
+	if fis, _ := ioutil.ReadDir(tmp); len(fis) != 0 {
+		t.Fatalf("expected the spooled zip %v to be removed", fis[0].Name())
+	}
+}
+
+// hungProtocol never answers before its context is done.
+type hungProtocol struct {
+	gdp.DownloadProtocol
+}
+
+func (hungProtocol) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	c := New(hungProtocol{}, WithTimeout(10*time.Millisecond))
+	if _, err := c.GoMod(context.Background(), "github.com/owner/repo", "v1.0.0"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the shared call to time out but got %v", err)
+	}
+}
@@ -3,43 +3,136 @@ package download
 import (
 	"context"
 	"io"
-	"strings"
 
 	"github.com/marwan-at-work/gdp/vanity"
 
 	"github.com/marwan-at-work/gdp"
 	"github.com/marwan-at-work/gdp/bitbucket"
+	"github.com/marwan-at-work/gdp/bitbucketserver"
+	"github.com/marwan-at-work/gdp/gitea"
 	"github.com/marwan-at-work/gdp/github"
+	"github.com/marwan-at-work/gdp/gitlab"
 	"github.com/marwan-at-work/gdp/gopkgin"
+	"github.com/marwan-at-work/gdp/local"
 )
 
 const (
 	gh  = "github.com"
 	bb  = "bitbucket.org"
+	gl  = "gitlab.com"
+	gt  = "gitea.com"
 	gpi = "gopkg.in"
 )
 
+// Option configures the DownloadProtocol returned by New.
+type Option func(*download)
+
+// WithGitHubEnterprise routes modules under host, such as
+// github.mycorp.com, to a GitHub Enterprise Server instance.
+// See github.NewEnterprise for baseURL and uploadURL. If they
+// are invalid, every module under host fails with that error.
+func WithGitHubEnterprise(host, baseURL, uploadURL, token string) Option {
+	return func(d *download) {
+		ch, err := github.NewEnterprise(baseURL, uploadURL, token)
+		if err != nil {
+			d.router.Handle(host, unavailable{err})
+			return
+		}
+		d.router.Handle(host, gdp.New(ch))
+	}
+}
+
+// WithGitLab routes modules under host to a GitLab
+// CodeHost at baseURL, authenticated with a private token.
+// It can be passed more than once for self-hosted instances,
+// or with host "gitlab.com" to authenticate against gitlab.com.
+func WithGitLab(host, baseURL, token string) Option {
+	return func(d *download) {
+		d.router.Handle(host, gdp.New(gitlab.New(baseURL, token)))
+	}
+}
+
+// WithGitea routes modules under host to a Gitea or Forgejo
+// CodeHost at baseURL, authenticated with an access token.
+// Vanity imports whose go-import meta tag points at host
+// are routed there as well.
+func WithGitea(host, baseURL, token string) Option {
+	return func(d *download) {
+		d.router.Handle(host, gdp.New(gitea.New(baseURL, token)))
+	}
+}
+
+// WithBitbucket authenticates against bitbucket.org, such as
+// with bitbucket.WithAppPassword, for private repositories.
+func WithBitbucket(opts ...bitbucket.Option) Option {
+	return func(d *download) {
+		d.router.Handle(bb, gdp.New(bitbucket.New(opts...)))
+	}
+}
+
+// WithBitbucketServer routes modules under host to a Bitbucket
+// Server or Data Center CodeHost at baseURL, authenticated with a
+// personal access token. Module paths follow its clone urls, such
+// as host/scm/proj/repo.
+func WithBitbucketServer(host, baseURL, token string) Option {
+	return func(d *download) {
+		d.router.Handle(host, gdp.New(bitbucketserver.New(baseURL, token)))
+	}
+}
+
+// WithLocal routes modules under host to git repositories
+// on disk in dir, laid out as dir/owner/repo.git, so that
+// host/owner/repo can be served without any network access.
+func WithLocal(host, dir string) Option {
+	return func(d *download) {
+		d.router.Handle(host, gdp.New(local.New(dir)))
+	}
+}
+
+// WithRoute routes modules under prefix to dp, such as an internal
+// github.com/mycorp organization to its own DownloadProtocol. Like
+// every route, the longest prefix wins, whole path elements at a time.
+func WithRoute(prefix string, dp gdp.DownloadProtocol) Option {
+	return func(d *download) {
+		d.router.Handle(prefix, dp)
+	}
+}
+
+// WithRouter routes modules through r, which the caller may keep
+// adding routes to afterwards. The routes of New, and of the options
+// before and after it, are added to r except for the prefixes that r
+// already has a route for, so that those of the caller win.
+func WithRouter(r *Router) Option {
+	return func(d *download) {
+		r.merge(d.router)
+		d.router = r
+	}
+}
+
 // New returns a DownloadProtocol that implements
-// Github, Bitbucket, and Gopkg.in.
-func New(githubToken string) gdp.DownloadProtocol {
+// Github, Bitbucket, GitLab, Gitea, and Gopkg.in.
+func New(githubToken string, opts ...Option) gdp.DownloadProtocol {
 	var d download
 	gch := github.New(githubToken)
 	g := gdp.New(gch)
 	b := gdp.New(bitbucket.New())
 	gpiDP := gopkgin.New(g, gch)
-	v := vanity.New(g, b)
-	d.protos = map[string]gdp.DownloadProtocol{
-		gh:  g,
-		bb:  b,
-		gpi: gpiDP,
+	d.router = NewRouter()
+	d.router.Handle(gh, g)
+	d.router.Handle(bb, b)
+	d.router.Handle(gl, gdp.New(gitlab.New(gitlab.DefaultURL, "")))
+	d.router.Handle(gt, gdp.New(gitea.New("https://"+gt, "")))
+	d.router.Handle(gpi, gpiDP)
+	for _, o := range opts {
+		o(&d)
 	}
-	d.vanity = v
+	d.vanity = vanity.New(d.router)
 
 	return &d
 }
 
 type download struct {
-	protos map[string]gdp.DownloadProtocol
+	router *Router
 	vanity gdp.DownloadProtocol
 }
 
@@ -64,11 +157,35 @@ func (d *download) Zip(ctx context.Context, module, version, zipPrefix string) (
 }
 
 func (d *download) deduceProtocol(module string) gdp.DownloadProtocol {
-	for prefix, dp := range d.protos {
-		if strings.HasPrefix(module, prefix) {
-			return dp
-		}
+	if dp, ok := d.router.Match(module); ok {
+		return dp
 	}
 
 	return d.vanity
 }
+
+// unavailable fails every request with err, for
+// a route whose code host could not be set up.
+type unavailable struct {
+	err error
+}
+
+func (u unavailable) List(context.Context, string) ([]string, error) {
+	return nil, u.err
+}
+
+func (u unavailable) Info(context.Context, string, string) (*gdp.RevInfo, error) {
+	return nil, u.err
+}
+
+func (u unavailable) Latest(context.Context, string) (*gdp.RevInfo, error) {
+	return nil, u.err
+}
+
+func (u unavailable) GoMod(context.Context, string, string) ([]byte, error) {
+	return nil, u.err
+}
+
+func (u unavailable) Zip(context.Context, string, string, string) (io.Reader, error) {
+	return nil, u.err
+}
@@ -0,0 +1,88 @@
+package download
+
+import (
+	"context"
+	"testing"
+
+	"github.com/marwan-at-work/gdp"
+)
+
+func TestRouter(t *testing.T) {
+	gh := gdp.New(nil)
+	ghe := gdp.New(nil)
+	corp := gdp.New(nil)
+	r := NewRouter()
+	r.Handle("github.com", gh)
+	r.Handle("github.company.com", ghe)
+	r.Handle("github.com/mycorp/", corp)
+
+	for path, expected := range map[string]gdp.DownloadProtocol{
+		"github.com/owner/repo":         gh,
+		"github.com":                    gh,
+		"github.company.com/owner/repo": ghe,
+		"github.com/mycorp/repo":        corp,
+		"github.com/mycorporation/repo": gh,
+		"github.co/owner/repo":          nil,
+	} {
+		dp, ok := r.Match(path)
+		if dp != expected || ok != (expected != nil) {
+			t.Fatalf("unexpected route for %v", path)
+		}
+	}
+
+	r.Handle("github.com", corp)
+	if dp, _ := r.Match("github.com/owner/repo"); dp != corp {
+		t.Fatal("expected github.com to be replaced")
+	}
+}
+
+func TestWithRoute(t *testing.T) {
+	corp := gdp.New(nil)
+	d := New("", WithRoute("github.com/mycorp", corp)).(*download)
+	if d.deduceProtocol("github.com/mycorp/repo") != corp {
+		t.Fatal("expected github.com/mycorp to route to its own protocol")
+	}
+	if d.deduceProtocol("github.com/owner/repo") == corp {
+		t.Fatal("expected github.com to keep its own protocol")
+	}
+	if d.deduceProtocol("go.mycorp.com/repo") != d.vanity {
+		t.Fatal("expected unknown hosts to be deduced from vanity imports")
+	}
+}
+
+func TestWithRouter(t *testing.T) {
+	corp := gdp.New(nil)
+	gh := gdp.New(nil)
+	r := NewRouter()
+	r.Handle("github.com", gh)
+	d := New("", WithLocal("git.mycorp.com", "/srv/git"), WithRouter(r)).(*download)
+
+	// the routes of New and of earlier options are kept,
+	// but those of the caller take precedence.
+	for _, path := range []string{"gitlab.com/owner/repo", "git.mycorp.com/owner/repo"} {
+		if dp, ok := d.router.Match(path); !ok || dp == nil {
+			t.Fatalf("expected a route for %v", path)
+		}
+	}
+	if dp, _ := d.router.Match("github.com/owner/repo"); dp != gh {
+		t.Fatal("expected the github.com route of the caller")
+	}
+
+	r.Handle("go.mycorp.com", corp)
+	if d.deduceProtocol("go.mycorp.com/repo") != corp {
+		t.Fatal("expected routes added afterwards to be used")
+	}
+}
+
+func TestWithGitHubEnterprise(t *testing.T) {
+	d := New("", WithGitHubEnterprise("github.mycorp.com", "https://github.mycorp.com", "", "")).(*download)
+	if dp, _ := d.router.Match("github.mycorp.com/owner/repo"); dp == nil || dp == d.vanity {
+		t.Fatal("expected github.mycorp.com to route to github enterprise")
+	}
+
+	d = New("", WithGitHubEnterprise("github.mycorp.com", "github.mycorp.com", "", "")).(*download)
+	_, err := d.List(context.Background(), "github.mycorp.com/owner/repo")
+	if err == nil {
+		t.Fatal("expected an error for an invalid base url")
+	}
+}
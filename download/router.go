@@ -0,0 +1,84 @@
+package download
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/marwan-at-work/gdp"
+)
+
+// Router routes module paths to the DownloadProtocol registered for
+// their longest matching prefix. Prefixes match whole path elements,
+// so github.com matches github.com/owner/repo but not github.company.com,
+// while github.com/mycorp takes precedence over github.com for
+// github.com/mycorp/repo. The zero value is an empty Router.
+type Router struct {
+	mu     sync.RWMutex
+	routes []route
+}
+
+type route struct {
+	prefix string
+	dp     gdp.DownloadProtocol
+}
+
+// NewRouter returns an empty Router.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle routes the modules under prefix to dp, replacing
+// any DownloadProtocol already registered for prefix.
+func (r *Router) Handle(prefix string, dp gdp.DownloadProtocol) {
+	prefix = strings.Trim(prefix, "/")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.routes {
+		if r.routes[i].prefix == prefix {
+			r.routes[i].dp = dp
+			return
+		}
+	}
+	r.routes = append(r.routes, route{prefix, dp})
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+}
+
+// merge adds the routes of other whose
+// prefixes r has no route of its own for.
+func (r *Router) merge(other *Router) {
+	other.mu.RLock()
+	routes := append([]route(nil), other.routes...)
+	other.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	has := map[string]bool{}
+	for _, rt := range r.routes {
+		has[rt.prefix] = true
+	}
+	for _, rt := range routes {
+		if !has[rt.prefix] {
+			r.routes = append(r.routes, rt)
+		}
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+}
+
+// Match returns the DownloadProtocol of the longest
+// prefix of path, and false if no prefix matches.
+func (r *Router) Match(path string) (gdp.DownloadProtocol, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rt := range r.routes {
+		if path == rt.prefix || strings.HasPrefix(path, rt.prefix+"/") {
+			return rt.dp, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,132 @@
+package gdp
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The kinds of errors a DownloadProtocol or CodeHost returns, so
+// that servers can answer with the right status code. They may be
+// wrapped, use errors.Is to find out the kind of an error.
+var (
+	// ErrNotFound is returned for a module, version
+	// or file that doesn't exist, or never did.
+	ErrNotFound = errors.New("not found")
+	// ErrGone is returned for a module or version that
+	// existed but was removed, such as a deleted tag.
+	ErrGone = errors.New("gone")
+	// ErrUnauthorized is returned when the code host rejects the
+	// credentials, or wants some for a private repository.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrRateLimited is returned when the code host rate limits
+	// requests. Use errors.As to get its RateLimitError, if any.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrInvalidVersion is returned for a version that can't
+	// be one of the module, such as v2.0.0 of a /v3 module.
+	ErrInvalidVersion = errors.New("invalid version")
+	// ErrUnavailable is returned when the code host can't
+	// be reached or fails to answer, such as with a 503.
+	ErrUnavailable = errors.New("upstream unavailable")
+	// ErrUnsupported is returned by a CodeHost for what
+	// its API can't do, such as listing branches.
+	ErrUnsupported = errors.New("unsupported by the code host")
+)
+
+// RateLimitError is an ErrRateLimited that knows when to retry.
+type RateLimitError struct {
+	// RetryAfter is how long the code host asked
+	// to wait before retrying, or zero if it didn't.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.RetryAfter <= 0 {
+		return ErrRateLimited.Error()
+	}
+
+	return fmt.Sprintf("%v, retry after %v", ErrRateLimited, e.RetryAfter)
+}
+
+// Is makes a RateLimitError an ErrRateLimited.
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// WithKind returns err, with its message, as an error of kind,
+// such as ErrNotFound or a *RateLimitError, so that errors.Is and
+// errors.As find both kind and what err wraps.
+func WithKind(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &kindError{kind, err}
+}
+
+type kindError struct {
+	kind, err error
+}
+
+func (e *kindError) Error() string              { return e.err.Error() }
+func (e *kindError) Unwrap() error              { return e.err }
+func (e *kindError) Is(target error) bool       { return errors.Is(e.kind, target) }
+func (e *kindError) As(target interface{}) bool { return errors.As(e.kind, target) }
+
+// Unavailable returns err, a failure to reach a code
+// host such as a timeout, as an ErrUnavailable.
+func Unavailable(err error) error {
+	return WithKind(ErrUnavailable, err)
+}
+
+// CheckResponse returns nil for a 2xx response of a code host, or
+// else the kind of error its status stands for, such as ErrNotFound
+// for a 404. Statuses of no particular kind get a plain error.
+func CheckResponse(resp *http.Response) error {
+	code := resp.StatusCode
+	switch {
+	case code >= 200 && code < 300:
+		return nil
+	case code == http.StatusNotFound:
+		return ErrNotFound
+	case code == http.StatusGone:
+		return ErrGone
+	case code == http.StatusTooManyRequests,
+		code == http.StatusForbidden && resp.Header.Get("Retry-After") != "",
+		code == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0":
+		return &RateLimitError{RetryAfter: retryAfter(resp.Header)}
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return ErrUnauthorized
+	}
+
+	err := fmt.Errorf("unexpected status %v", code)
+	if resp.Request != nil {
+		err = fmt.Errorf("%v unexpected status %v", resp.Request.URL, code)
+	}
+	if code >= 500 {
+		return &kindError{ErrUnavailable, err}
+	}
+
+	return err
+}
+
+// retryAfter reads the Retry-After header, in seconds or as
+// a date, or else the X-RateLimit-Reset time of GitHub and Gitea.
+func retryAfter(h http.Header) time.Duration {
+	if ra := h.Get("Retry-After"); ra != "" {
+		if secs, err := strconv.Atoi(ra); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(ra); err == nil {
+			return time.Until(t).Round(time.Second)
+		}
+	}
+	if reset, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		return time.Until(time.Unix(reset, 0)).Round(time.Second)
+	}
+
+	return 0
+}
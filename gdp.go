@@ -3,22 +3,36 @@ package gdp
 import (
 	"context"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/marwan-at-work/vgop/semver"
 	"github.com/pkg/errors"
 )
 
-// ErrNotFound error
-var ErrNotFound = errors.New("not found")
-
 // DownloadProtocol of cmd/go
 type DownloadProtocol interface {
 	List(ctx context.Context, module string) ([]string, error)
 	Info(ctx context.Context, module, version string) (*RevInfo, error)
 	Latest(ctx context.Context, module string) (*RevInfo, error)
 	GoMod(ctx context.Context, module, version string) ([]byte, error)
-	Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) // potentially zip.ReadCloser?
+	// Zip returns a reader of the module zip, which may also be an
+	// io.Closer that releases what's behind it, such as a temporary
+	// file or a connection. Callers close it when they are done,
+	// since they may stop reading before the end.
+	Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error)
+}
+
+// CloseReader closes r if it's an io.Closer, such as
+// the reader of DownloadProtocol.Zip once it's done.
+func CloseReader(r io.Reader) error {
+	if c, ok := r.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
 }
 
 // RevInfo describes a single revision in a module repository.
@@ -38,62 +52,202 @@ type CodeHost interface {
 	CommitInfo(ctx context.Context, owner, repo, sha string) (*RevInfo, error)
 	TagInfo(ctx context.Context, owner, repo, tag string) (*RevInfo, error)
 	LatestCommit(ctx context.Context, owner, repo string) (sha string, t time.Time, err error)
-	GetModFile(ctx context.Context, owner, repo, version string) ([]byte, error)
+	// GetModFile returns the go.mod file of the module rooted at dir,
+	// a slash separated path relative to the repository root that is
+	// empty for the root itself.
+	GetModFile(ctx context.Context, owner, repo, dir, version string) ([]byte, error)
 	TarURL(ctx context.Context, owner, repo, version string) (string, error)
 }
 
+// ArchiveFormat is the encoding of a repository archive.
+type ArchiveFormat int
+
+// Archive formats an Archiver can return.
+const (
+	ArchiveTarGz ArchiveFormat = iota
+	ArchiveZip
+)
+
+// AncestorChecker is an optional interface a CodeHost can implement
+// to report whether ancestor, a tag or commit, is reachable from the
+// commit rev. generic uses it to base pseudo-versions on the latest
+// tag before a commit, and falls back to vX.0.0 pseudo-versions
+// for hosts that don't implement it.
+type AncestorChecker interface {
+	IsAncestor(ctx context.Context, owner, repo, ancestor, rev string) (bool, error)
+}
+
+// Archiver is an optional interface a CodeHost can implement
+// to stream an archive of a repository at the given ref itself,
+// with its own authentication, instead of handing back a TarURL
+// for generic.Zip to download. Archives are expected to hold a
+// single top level directory, like GitHub's tarballs.
+type Archiver interface {
+	Archive(ctx context.Context, owner, repo, ref string) (io.ReadCloser, ArchiveFormat, error)
+}
+
+// PathSplitter is an optional interface a CodeHost can implement
+// when its repositories don't live at host/owner/repo, such as
+// Bitbucket Server's host/scm/project/repo. SplitModule is then
+// used instead of the package level one to find out where a module
+// path, without its major version suffix, lives on the code host.
+type PathSplitter interface {
+	SplitModule(path string) (owner, repo, dir string, err error)
+}
+
 // PseudoTime for a shortened commit sha: YYYYMMDDHHMMSS
 const PseudoTime = "20060102150405"
 
+// pseudoRE matches the three pseudo-version forms cmd/go uses:
+// vX.0.0-yyyymmddhhmmss-abcdefabcdef when there is no earlier tag,
+// vX.Y.(Z+1)-0.yyyymmddhhmmss-abcdefabcdef after the release vX.Y.Z
+// and vX.Y.Z-pre.0.yyyymmddhhmmss-abcdefabcdef after the pre-release vX.Y.Z-pre.
+var pseudoRE = regexp.MustCompile(`^v[0-9]+\.(0\.0-|\d+\.\d+-([^+]*\.)?0\.)\d{14}-[A-Za-z0-9]+(\+[0-9A-Za-z-]+(\.[0-9A-Za-z-]+)*)?$`)
+
 // IsPseudo returns whether the tag
 // comes from a sha or a valid semver tag
 func IsPseudo(v string) bool {
-	vinfo := strings.Split(v, "-")
-	if len(vinfo) < 3 {
-		return false
-	}
-	_, err := time.Parse(PseudoTime, vinfo[1])
-	return vinfo[0] == "v0.0.0" && err == nil
+	return strings.Count(v, "-") >= 2 && semver.IsValid(v) && pseudoRE.MatchString(v)
 }
 
 // Pseudo takes a time and a short sha and returns
 // v0.0.0-formattedTime-shortSha
 func Pseudo(t time.Time, shortSha string) string {
-	return "v0.0.0-" + t.Format(PseudoTime) + "-" + shortSha
+	return PseudoVersion("", "", t, shortSha)
 }
 
-// ShaFromPseudo takes v0.0.0-formattedTime-shortSha
-// and returns shortSha
+// PseudoVersion returns a pseudo-version for the given major
+// version ("v1"), the latest tag before the commit (older), which
+// may be empty, the commit time and its short sha. Like cmd/go,
+// the result sorts above older and below any later release.
+func PseudoVersion(major, older string, t time.Time, shortSha string) string {
+	if major == "" {
+		major = "v0"
+	}
+	segment := t.UTC().Format(PseudoTime) + "-" + shortSha
+	build := semver.Build(older)
+	older = semver.Canonical(older)
+	if older == "" {
+		return major + ".0.0-" + segment
+	}
+	if semver.Prerelease(older) != "" {
+		return older + ".0." + segment + build
+	}
+	// bump the patch of vMAJOR.MINOR.PATCH
+	i := strings.LastIndex(older, ".") + 1
+	patch, _ := strconv.Atoi(older[i:])
+
+	return older[:i] + strconv.Itoa(patch+1) + "-0." + segment + build
+}
+
+// ShaFromPseudo takes a pseudo-version in any
+// of its forms and returns its shortSha
 func ShaFromPseudo(sv string) (string, error) {
-	vinfo := strings.Split(sv, "-")
-	if len(vinfo) < 3 {
+	if !IsPseudo(sv) {
 		return "", errors.New("incorrect pseudo version: " + sv)
 	}
+	sv = strings.TrimSuffix(sv, semver.Build(sv))
+
+	return sv[strings.LastIndex(sv, "-")+1:], nil
+}
+
+// TimeFromPseudo returns the commit time encoded in a pseudo-version.
+func TimeFromPseudo(sv string) (time.Time, error) {
+	if !IsPseudo(sv) {
+		return time.Time{}, errors.New("incorrect pseudo version: " + sv)
+	}
+	sv = strings.TrimSuffix(sv, semver.Build(sv))
+	sv = sv[:strings.LastIndex(sv, "-")]
 
-	return vinfo[2], nil
+	return time.Parse(PseudoTime, sv[len(sv)-len(PseudoTime):])
 }
 
 // SplitPath takes a valid import path such as
-// github.com/a/b and returns the owner and repo (a, b)
+// github.com/a/b and returns the owner and repo (a, b).
+// The host is not inspected, so self-hosted code hosts
+// such as gitlab.mycorp.com/a/b split the same way.
+// Plain git servers that keep repositories at the root,
+// such as go.googlesource.com/net, have an empty owner.
 func SplitPath(path string) (owner, repo string, err error) {
+	owner, repo, dir, err := SplitModule(path)
+	if err == nil && dir != "" {
+		err = errors.Wrap(ErrNotFound, "splitPath: unparsable path: "+path)
+	}
+
+	return owner, repo, err
+}
+
+// SplitModule is like SplitPath but also accepts modules
+// that live in a subdirectory of their repository, such as
+// github.com/a/b/c/d, and returns that directory (c/d) as well.
+// dir is empty for modules at the root of their repository.
+func SplitModule(path string) (owner, repo, dir string, err error) {
 	els := strings.Split(path, "/")
-	switch els[0] {
-	case "github.com", "bitbucket.org":
-		if len(els) != 3 {
-			return "", "", errors.New("splitPath: unparsable path: " + path)
-		}
-		owner = els[1]
-		repo = els[2]
+	if els[0] == "gopkg.in" {
+		return "", "", "", ErrGopkg
+	}
+	switch {
+	case len(els) == 2:
+		return "", els[1], "", nil
+	case len(els) >= 3:
+		return els[1], els[2], strings.Join(els[3:], "/"), nil
+	}
 
-		return owner, repo, nil
-	case "gopkg.in":
-		return "", "", ErrGopkg
+	// no repository can be at such a path.
+	return "", "", "", errors.Wrap(ErrNotFound, "splitModule: unparsable path: "+path)
+}
+
+// SplitPathVersion returns prefix and major version such that prefix+pathMajor == path
+// and version is either empty or "/vN" for N >= 2.
+// As a special case, gopkg.in paths are recognized directly;
+// they require ".vN" instead of "/vN", and for all N, not just N >= 2.
+func SplitPathVersion(path string) (prefix, pathMajor string, ok bool) {
+	if strings.HasPrefix(path, "gopkg.in/") {
+		return splitGopkgIn(path)
 	}
 
-	return "", "", ErrUnsupportedAPI
+	i := len(path)
+	dot := false
+	for i > 0 && ('0' <= path[i-1] && path[i-1] <= '9' || path[i-1] == '.') {
+		if path[i-1] == '.' {
+			dot = true
+		}
+		i--
+	}
+	if i <= 1 || path[i-1] != 'v' || path[i-2] != '/' {
+		return path, "", true
+	}
+	prefix, pathMajor = path[:i-2], path[i-2:]
+	if dot || len(pathMajor) <= 2 || pathMajor[2] == '0' || pathMajor == "/v1" {
+		return path, "", false
+	}
+	return prefix, pathMajor, true
+}
+
+// splitGopkgIn is like SplitPathVersion but only for gopkg.in paths.
+func splitGopkgIn(path string) (prefix, pathMajor string, ok bool) {
+	if !strings.HasPrefix(path, "gopkg.in/") {
+		return path, "", false
+	}
+	i := len(path)
+	for i > 0 && ('0' <= path[i-1] && path[i-1] <= '9') {
+		i--
+	}
+	if i <= 1 || path[i-1] != 'v' || path[i-2] != '.' {
+		// All gopkg.in paths must end in vN for some N.
+		return path, "", false
+	}
+	prefix, pathMajor = path[:i-2], path[i-2:]
+	if len(pathMajor) <= 2 || pathMajor[2] == '0' && pathMajor != ".v0" {
+		return path, "", false
+	}
+	return prefix, pathMajor, true
 }
 
 // ErrUnsupportedAPI encourages vanity
+//
+// Deprecated: nothing returns it since SplitPath
+// splits the paths of any host the same way.
 var ErrUnsupportedAPI = errors.New("unsupported API")
 
 // ErrGopkg so that a protocol can switch from SplitPath
@@ -105,7 +259,7 @@ var ErrGopkg = errors.New("use ParseGopkgPath")
 func ParseGopkgPath(path string) (owner, repo, major string, err error) {
 	els := strings.Split(path, "/")
 	if len(els) < 2 || len(els) > 3 {
-		return "", "", "", errors.New("pkginSplit: unparsable path" + path)
+		return "", "", "", errors.Wrap(ErrNotFound, "pkginSplit: unparsable path: "+path)
 	}
 
 	owner = els[1]
@@ -116,7 +270,7 @@ func ParseGopkgPath(path string) (owner, repo, major string, err error) {
 	}
 	vidx := strings.Index(vloc, ".v")
 	if vidx == -1 {
-		return "", "", "", errors.New("gopkin missing version from path " + path)
+		return "", "", "", errors.Wrap(ErrNotFound, "gopkin missing version from path "+path)
 	}
 	major = vloc[vidx+1:]
 	if len(els) == 2 {
@@ -1,7 +1,27 @@
 package gdp
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/mod/sumdb/dirhash"
 )
 
 // TODO: can use way more testing.
@@ -23,3 +43,678 @@ func eq(t *testing.T, s1, s2 string) {
 		t.Fatalf("expected %v and %v to be equal", s1, s2)
 	}
 }
+
+// fakeHost is a CodeHost that serves a fixed set of
+// files from an archive of the given format.
+type fakeHost struct {
+	format ArchiveFormat
+	files  map[string]string
+	tags   []string
+	tarURL string
+	// modless lists the refs that have no go.mod file.
+	modless map[string]bool
+}
+
+func (f *fakeHost) Branches(ctx context.Context, owner, repo string) ([]string, error) {
+	return []string{"master"}, nil
+}
+
+func (f *fakeHost) Tags(ctx context.Context, owner, repo string) ([]string, error) {
+	return f.tags, nil
+}
+
+func (f *fakeHost) CommitInfo(ctx context.Context, owner, repo, sha string) (*RevInfo, error) {
+	return nil, ErrNotFound
+}
+
+func (f *fakeHost) TagInfo(ctx context.Context, owner, repo, tag string) (*RevInfo, error) {
+	for _, t := range f.tags {
+		if t == tag {
+			return &RevInfo{Name: "0123456789abcdef", Short: tag, Version: tag}, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+func (f *fakeHost) LatestCommit(ctx context.Context, owner, repo string) (string, time.Time, error) {
+	return "", time.Time{}, ErrNotFound
+}
+
+func (f *fakeHost) GetModFile(ctx context.Context, owner, repo, dir, version string) ([]byte, error) {
+	mod, ok := f.files[path.Join(dir, "go.mod")]
+	if !ok || f.modless[version] {
+		return nil, ErrNotFound
+	}
+
+	return []byte(mod), nil
+}
+
+func (f *fakeHost) TarURL(ctx context.Context, owner, repo, version string) (string, error) {
+	return f.tarURL, nil
+}
+
+// branchlessHost is a fakeHost that can't list its branches,
+// but resolves the master branch like any commit.
+type branchlessHost struct {
+	fakeHost
+}
+
+func (b *branchlessHost) Branches(ctx context.Context, owner, repo string) ([]string, error) {
+	return nil, ErrUnsupported
+}
+
+func (b *branchlessHost) CommitInfo(ctx context.Context, owner, repo, sha string) (*RevInfo, error) {
+	if sha != "master" {
+		return nil, ErrNotFound
+	}
+	return &RevInfo{Name: "0123456789abcdef", Short: "0123456789ab", Time: time.Date(2018, 3, 11, 21, 45, 15, 0, time.UTC)}, nil
+}
+
+func TestQueryWithoutBranches(t *testing.T) {
+	d := New(&branchlessHost{})
+	info, err := d.Info(context.Background(), "example.com/owner/repo", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "v0.0.0-20180311214515-0123456789ab", info.Version)
+
+	if _, err := d.Info(context.Background(), "example.com/owner/repo", "nope"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing branch but got %v", err)
+	}
+}
+
+// archiveHost adds Archive to fakeHost.
+type archiveHost struct {
+	fakeHost
+}
+
+func (f *archiveHost) Archive(ctx context.Context, owner, repo, ref string) (io.ReadCloser, ArchiveFormat, error) {
+	var bts []byte
+	dir := repo + "-" + strings.Replace(ref, "/", "-", -1) + "/"
+	if f.format == ArchiveZip {
+		bts = zipball(dir, f.files)
+	} else {
+		bts = tarball(dir, f.files)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(bts)), f.format, nil
+}
+
+func tarball(dir string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755})
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: dir + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+
+	return buf.Bytes()
+}
+
+func zipball(dir string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	zw.Create(dir)
+	for name, content := range files {
+		w, _ := zw.Create(dir + name)
+		w.Write([]byte(content))
+	}
+	zw.Close()
+
+	return buf.Bytes()
+}
+
+func zipContents(t *testing.T, rdr io.Reader) map[string]string {
+	t.Helper()
+	bts, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(bts), int64(len(bts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(content)
+	}
+
+	return files
+}
+
+func TestPseudoVersion(t *testing.T) {
+	tm := time.Date(2018, 3, 11, 21, 45, 15, 0, time.UTC)
+	for _, tc := range []struct {
+		major, older, expected string
+	}{
+		{"", "", "v0.0.0-20180311214515-abcdefabcdef"},
+		{"v2", "", "v2.0.0-20180311214515-abcdefabcdef"},
+		{"v1", "v1.2.3", "v1.2.4-0.20180311214515-abcdefabcdef"},
+		{"v1", "v1.2.3-pre", "v1.2.3-pre.0.20180311214515-abcdefabcdef"},
+		{"v2", "v2.0.9+incompatible", "v2.0.10-0.20180311214515-abcdefabcdef+incompatible"},
+	} {
+		v := PseudoVersion(tc.major, tc.older, tm, "abcdefabcdef")
+		eq(t, tc.expected, v)
+		if !IsPseudo(v) {
+			t.Fatalf("expected %v to be a pseudo-version", v)
+		}
+		sha, err := ShaFromPseudo(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eq(t, "abcdefabcdef", sha)
+		pt, err := TimeFromPseudo(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !pt.Equal(tm) {
+			t.Fatalf("unexpected time %v from %v", pt, v)
+		}
+	}
+
+	for _, v := range []string{"v1.2.3", "v1.2.3-pre", "v0.0.0-2018-abc", "master"} {
+		if IsPseudo(v) {
+			t.Fatalf("expected %v not to be a pseudo-version", v)
+		}
+	}
+}
+
+func TestSplitModule(t *testing.T) {
+	for _, tc := range []struct {
+		path, owner, repo, dir string
+	}{
+		{"go.googlesource.com/net", "", "net", ""},
+		{"github.com/owner/repo", "owner", "repo", ""},
+		{"github.com/owner/repo/sub/module", "owner", "repo", "sub/module"},
+	} {
+		owner, repo, dir, err := SplitModule(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eq(t, tc.owner, owner)
+		eq(t, tc.repo, repo)
+		eq(t, tc.dir, dir)
+	}
+
+	if _, _, err := SplitPath("github.com/owner/repo/sub"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected SplitPath to reject a subdirectory with ErrNotFound but got %v", err)
+	}
+	if _, _, _, err := SplitModule("github.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a path without a repository but got %v", err)
+	}
+	if _, err := New(&fakeHost{}).Info(context.Background(), "github.com/owner/repo/v1", "v1.0.0"); !errors.Is(err, ErrInvalidVersion) {
+		t.Fatalf("expected ErrInvalidVersion for a /v1 suffix but got %v", err)
+	}
+}
+
+func TestSubdirectoryModule(t *testing.T) {
+	ch := &archiveHost{fakeHost{
+		files: map[string]string{
+			"go.mod":                   "module example.com/owner/repo\n",
+			"repo.go":                  "package repo\n",
+			"sub/module/go.mod":        "module example.com/owner/repo/sub/module\n",
+			"sub/module/module.go":     "package module\n",
+			"sub/module/inner/x.go":    "package inner\n",
+			"sub/module/nested/go.mod": "module example.com/owner/repo/sub/module/nested\n",
+			"sub/module/nested/n.go":   "package nested\n",
+		},
+		tags: []string{"v1.0.0", "sub/module/v1.2.0", "sub/module/v1.3.0", "sub/other/v2.0.0"},
+	}}
+	d := New(ch)
+	ctx := context.Background()
+	module := "example.com/owner/repo/sub/module"
+
+	tags, err := d.List(ctx, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"v1.2.0", "v1.3.0"}) {
+		t.Fatalf("unexpected list versions %v", tags)
+	}
+
+	info, err := d.Info(ctx, module, "v1.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "v1.2.0", info.Version)
+
+	mod, err := d.GoMod(ctx, module, "v1.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "module example.com/owner/repo/sub/module\n", string(mod))
+
+	rdr, err := d.Zip(ctx, module, "v1.2.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := zipContents(t, rdr)
+	expected := map[string]string{
+		module + "@v1.2.0/go.mod":     "module example.com/owner/repo/sub/module\n",
+		module + "@v1.2.0/module.go":  "package module\n",
+		module + "@v1.2.0/inner/x.go": "package inner\n",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected zip files %v", got)
+	}
+
+	// the root module leaves out every nested module.
+	rdr, err = d.Zip(ctx, "example.com/owner/repo", "v1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = zipContents(t, rdr)
+	expected = map[string]string{
+		"example.com/owner/repo@v1.0.0/go.mod":  "module example.com/owner/repo\n",
+		"example.com/owner/repo@v1.0.0/repo.go": "package repo\n",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("unexpected zip files %v", got)
+	}
+}
+
+func TestMajorVersion(t *testing.T) {
+	tags := []string{"v1.0.0", "v2.0.0", "v2.1.0", "v3.0.0"}
+	module := "example.com/owner/repo/v2"
+	for _, tc := range []struct {
+		layout string
+		files  map[string]string
+	}{
+		{"major branch", map[string]string{
+			"go.mod":  "module example.com/owner/repo/v2\n",
+			"repo.go": "package repo\n",
+		}},
+		{"major subdirectory", map[string]string{
+			"go.mod":     "module example.com/owner/repo\n",
+			"repo.go":    "package repo // v1\n",
+			"v2/go.mod":  "module example.com/owner/repo/v2\n",
+			"v2/repo.go": "package repo\n",
+		}},
+	} {
+		d := New(&archiveHost{fakeHost{files: tc.files, tags: tags}})
+		ctx := context.Background()
+
+		list, err := d.List(ctx, module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(list, []string{"v2.0.0", "v2.1.0"}) {
+			t.Fatalf("%v: unexpected list versions %v", tc.layout, list)
+		}
+
+		if _, err := d.Info(ctx, module, "v3.0.0"); !errors.Is(err, ErrInvalidVersion) {
+			t.Fatalf("%v: expected ErrInvalidVersion for a mismatched major version but got %v", tc.layout, err)
+		}
+
+		mod, err := d.GoMod(ctx, module, "v2.1.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		eq(t, "module example.com/owner/repo/v2\n", string(mod))
+
+		rdr, err := d.Zip(ctx, module, "v2.1.0", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := zipContents(t, rdr)
+		expected := map[string]string{
+			module + "@v2.1.0/go.mod":  "module example.com/owner/repo/v2\n",
+			module + "@v2.1.0/repo.go": "package repo\n",
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("%v: unexpected zip files %v", tc.layout, got)
+		}
+	}
+}
+
+func TestIncompatible(t *testing.T) {
+	ch := &archiveHost{fakeHost{
+		files:   map[string]string{"go.mod": "module example.com/owner/repo/v3\n"},
+		tags:    []string{"v1.0.0", "v2.0.0", "v2.3.0", "v3.0.0"},
+		modless: map[string]bool{"v1.0.0": true, "v2.0.0": true, "v2.3.0": true},
+	}}
+	d := New(ch)
+	ctx := context.Background()
+	module := "example.com/owner/repo"
+
+	list, err := d.List(ctx, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"v1.0.0", "v2.0.0+incompatible", "v2.3.0+incompatible"}
+	if !reflect.DeepEqual(list, expected) {
+		t.Fatalf("unexpected list versions %v", list)
+	}
+
+	for _, v := range []string{"v2.3.0", "v2.3.0+incompatible"} {
+		info, err := d.Info(ctx, module, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eq(t, "v2.3.0+incompatible", info.Version)
+	}
+
+	// v3.0.0 opted into modules, so it belongs to the /v3 path.
+	if _, err := d.Info(ctx, module, "v3.0.0+incompatible"); err == nil {
+		t.Fatal("expected an error for a tag with a go.mod file")
+	}
+	list, err = d.List(ctx, module+"/v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []string{"v3.0.0"}) {
+		t.Fatalf("unexpected list versions %v", list)
+	}
+
+	mod, err := d.GoMod(ctx, module, "v2.3.0+incompatible")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "module example.com/owner/repo\n", string(mod))
+}
+
+// aheadHost is an archiveHost whose default branch
+// is a commit ahead of every one of its tags.
+type aheadHost struct {
+	archiveHost
+}
+
+func (a *aheadHost) LatestCommit(ctx context.Context, owner, repo string) (string, time.Time, error) {
+	return "abcdefabcdef0123", time.Date(2018, 3, 11, 21, 45, 15, 0, time.UTC), nil
+}
+
+func (a *aheadHost) IsAncestor(ctx context.Context, owner, repo, ancestor, rev string) (bool, error) {
+	return true, nil
+}
+
+func TestIncompatiblePseudoVersion(t *testing.T) {
+	d := New(&aheadHost{archiveHost{fakeHost{
+		files:   map[string]string{"go.mod": "module example.com/owner/repo/v3\n"},
+		tags:    []string{"v1.0.0", "v2.3.0", "v3.0.0"},
+		modless: map[string]bool{"v1.0.0": true, "v2.3.0": true},
+	}}})
+	ctx := context.Background()
+
+	// v3.0.0 has a go.mod file, so the latest release of
+	// the path without a major version is v2.3.0+incompatible.
+	info, err := d.Latest(ctx, "example.com/owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "v2.3.1-0.20180311214515-abcdefabcdef+incompatible", info.Version)
+
+	info, err = d.Latest(ctx, "example.com/owner/repo/v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eq(t, "v3.0.1-0.20180311214515-abcdefabcdef", info.Version)
+}
+
+func TestZipFromArchiver(t *testing.T) {
+	files := map[string]string{"go.mod": "module example.com/owner/repo\n", "sub/sub.go": "package sub\n"}
+	expected := map[string]string{
+		"example.com/owner/repo@v1.0.0/go.mod":     "module example.com/owner/repo\n",
+		"example.com/owner/repo@v1.0.0/sub/sub.go": "package sub\n",
+	}
+	for _, format := range []ArchiveFormat{ArchiveTarGz, ArchiveZip} {
+		ch := &archiveHost{fakeHost{format: format, files: files}}
+		rdr, err := New(ch).Zip(context.Background(), "example.com/owner/repo", "v1.0.0", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := zipContents(t, rdr)
+		if !reflect.DeepEqual(got, expected) {
+			names := []string{}
+			for name := range got {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			t.Fatalf("format %v: unexpected zip files %v", format, names)
+		}
+	}
+}
+
+func TestZipFromTarURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repo.tar.gz" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(tarball("repo-v1.0.0/", map[string]string{"go.mod": "module example.com/owner/repo\n"}))
+	}))
+	defer srv.Close()
+
+	ch := &fakeHost{tarURL: srv.URL + "/repo.tar.gz"}
+	rdr, err := New(ch).Zip(context.Background(), "example.com/owner/repo", "v1.0.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := zipContents(t, rdr)
+	if got["example.com/owner/repo@v1.0.0/go.mod"] != "module example.com/owner/repo\n" {
+		t.Fatalf("unexpected zip files %v", got)
+	}
+
+	ch.tarURL = srv.URL + "/missing.tar.gz"
+	if _, err := New(ch).Zip(context.Background(), "example.com/owner/repo", "v1.0.0", ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound for a missing tarball but got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch.tarURL = srv.URL + "/repo.tar.gz"
+	if _, err := New(ch).Zip(ctx, "example.com/owner/repo", "v1.0.0", ""); err == nil {
+		t.Fatal("expected an error for a canceled context")
+	}
+}
+
+// modFiles returns the go.mod files in a fixture tarball
+// by their path relative to the repository root.
+func modFiles(t *testing.T, fixture string) map[string]string {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return files
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		name := strings.SplitN(h.Name, "/", 2)[1]
+		if h.Typeflag == tar.TypeReg && path.Base(name) == "go.mod" {
+			bts, _ := ioutil.ReadAll(tr)
+			files[name] = string(bts)
+		}
+	}
+}
+
+// TestZipConformance checks zips against the go.sum lines of real
+// modules. The fixtures are GitHub style tarballs of the modules with
+// a vendor directory, a nested module and a symlink thrown in, or
+// with the module in a major version subdirectory.
+func TestZipConformance(t *testing.T) {
+	srv := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		fixture, module, version string
+		zipSum, modSum           string
+	}{
+		{
+			"pkg-errors-v0.9.1.tar.gz", "github.com/pkg/errors", "v0.9.1",
+			"h1:FEBLx1zS214owpjy7qsBeixbURkuhQAwrK5UwLGTwt4=",
+			"h1:bwawxfHBFNV+L2hUp1rHADufV3IMtnDRdf1r5NINEl0=",
+		},
+		{
+			"sony-gobreaker-v2.4.0.tar.gz", "github.com/sony/gobreaker/v2", "v2.4.0",
+			"h1:g2KJRW1Ubty3+ZOcSEUN7K+REQJdN6yo6XvaML+jptg=",
+			"h1:pTyFJgcZ3h2tdQVLZZruK2C0eoFL1fb/G83wK1ZQl+s=",
+		},
+	} {
+		d := New(&fakeHost{tarURL: srv.URL + "/" + tc.fixture, files: modFiles(t, tc.fixture)})
+		rdr, err := d.Zip(context.Background(), tc.module, tc.version, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ioutil.TempFile("", "gdp-zip")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		_, err = io.Copy(f, rdr)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, err := dirhash.HashZip(f.Name(), dirhash.Hash1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eq(t, tc.zipSum, sum)
+
+		mod, err := d.GoMod(context.Background(), tc.module, tc.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, err = dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(mod)), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		eq(t, tc.modSum, sum)
+	}
+}
+
+func TestZipInvalidFiles(t *testing.T) {
+	for name, files := range map[string]map[string]string{
+		"case collision": {"a.go": "package a\n", "A.go": "package a\n"},
+		"large go.mod":   {"go.mod": "module example.com/owner/repo\n" + strings.Repeat("\n", 16<<20)},
+	} {
+		ch := &archiveHost{fakeHost{files: files}}
+		_, err := New(ch).Zip(context.Background(), "example.com/owner/repo", "v1.0.0", "")
+		if err == nil {
+			t.Fatalf("%v: expected an error", name)
+		}
+	}
+}
+
+func TestZipTooLarge(t *testing.T) {
+	defer func(max int64) { maxModuleSize = max }(maxModuleSize)
+	maxModuleSize = 16
+
+	files := map[string]string{"go.mod": "module example.com/owner/repo\n", "a.go": "package a\n"}
+	ch := &archiveHost{fakeHost{files: files}}
+	_, err := New(ch).Zip(context.Background(), "example.com/owner/repo", "v1.0.0", "")
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("expected a too large error but got %v", err)
+	}
+}
+
+func TestZipClose(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "gdp-close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	files := map[string]string{"go.mod": "module example.com/owner/repo\n", "a.go": "package a\n"}
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, stop := range []func(io.Reader){
+		func(rdr io.Reader) { CloseReader(rdr) },
+		func(io.Reader) { cancel() },
+	} {
+		rdr, err := New(&archiveHost{fakeHost{files: files}}).Zip(ctx, "example.com/owner/repo", "v1.0.0", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rdr.Read(make([]byte, 1))
+		stop(rdr)
+
+		// the extracted files are removed once the writer stops.
+		for i := 0; ; i++ {
+			if fis, _ := ioutil.ReadDir(tmp); len(fis) == 0 {
+				break
+			} else if i == 1000 {
+				t.Fatalf("expected the extracted files to be removed but got %v", fis[0].Name())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	for _, tc := range []struct {
+		code     int
+		header   http.Header
+		expected error
+	}{
+		{200, nil, nil},
+		{404, nil, ErrNotFound},
+		{410, nil, ErrGone},
+		{401, nil, ErrUnauthorized},
+		{403, nil, ErrUnauthorized},
+		{429, nil, ErrRateLimited},
+		{403, http.Header{"X-Ratelimit-Remaining": {"0"}}, ErrRateLimited},
+		{400, nil, nil},
+		{502, nil, ErrUnavailable},
+		{503, nil, ErrUnavailable},
+	} {
+		resp := &http.Response{StatusCode: tc.code, Header: tc.header}
+		if resp.Header == nil {
+			resp.Header = http.Header{}
+		}
+		err := CheckResponse(resp)
+		if (err == nil) != (tc.code == 200) || tc.expected != nil && !errors.Is(err, tc.expected) {
+			t.Fatalf("unexpected error %v for %v", err, tc.code)
+		}
+		for _, kind := range []error{ErrNotFound, ErrGone, ErrUnauthorized, ErrRateLimited, ErrUnavailable} {
+			if kind != tc.expected && errors.Is(err, kind) {
+				t.Fatalf("expected %v not to be %v", tc.code, kind)
+			}
+		}
+	}
+
+	resp := &http.Response{StatusCode: 429, Header: http.Header{"Retry-After": {"120"}}}
+	var rle *RateLimitError
+	if err := errors.Wrap(CheckResponse(resp), "wrapped"); !errors.As(err, &rle) || rle.RetryAfter != 2*time.Minute {
+		t.Fatalf("expected to retry after 2m but got %v", err)
+	}
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	resp = &http.Response{StatusCode: 403, Header: http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {reset}}}
+	if !errors.As(CheckResponse(resp), &rle) || rle.RetryAfter < 59*time.Minute {
+		t.Fatalf("expected to retry after an hour but got %v", rle.RetryAfter)
+	}
+
+	err := errors.Wrap(Unavailable(context.DeadlineExceeded), "wrapped")
+	if !errors.Is(err, ErrUnavailable) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v to be both unavailable and a deadline", err)
+	}
+
+	err = WithKind(&RateLimitError{RetryAfter: time.Minute}, context.DeadlineExceeded)
+	if !errors.Is(err, ErrRateLimited) || !errors.As(err, &rle) || rle.RetryAfter != time.Minute || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected %v to be both rate limited and a deadline", err)
+	}
+}
@@ -0,0 +1,227 @@
+package gitea
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+)
+
+// New returns a Gitea (or Forgejo) implementation of the
+// CodeHost api that talks to the v1 REST API of the instance
+// at baseURL such as https://gitea.com. tok is an optional
+// access token. Use gdp.New to create a download protocol out of it.
+func New(baseURL, tok string) gdp.CodeHost {
+	return &client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   tok,
+		c:       http.DefaultClient,
+	}
+}
+
+type client struct {
+	baseURL string
+	token   string
+	c       *http.Client
+}
+
+const pageLimit = 50
+
+func (c *client) Tags(ctx context.Context, owner, repo string) ([]string, error) {
+	tags := []string{}
+	for page := 1; ; page++ {
+		var refs []tagResponse
+		u := c.repoURL(owner, repo) + "/tags?limit=" + strconv.Itoa(pageLimit) + "&page=" + strconv.Itoa(page)
+		if err := c.getJSON(ctx, u, &refs); err != nil {
+			return nil, errors.Wrapf(err, "gitea.Tags page %v", page)
+		}
+		if len(refs) == 0 {
+			break
+		}
+		for _, t := range refs {
+			tags = append(tags, t.Name)
+		}
+	}
+
+	return tags, nil
+}
+
+func (c *client) Branches(ctx context.Context, owner, repo string) ([]string, error) {
+	branches := []string{}
+	for page := 1; ; page++ {
+		var refs []branchResponse
+		u := c.repoURL(owner, repo) + "/branches?limit=" + strconv.Itoa(pageLimit) + "&page=" + strconv.Itoa(page)
+		if err := c.getJSON(ctx, u, &refs); err != nil {
+			return nil, errors.Wrapf(err, "gitea.Branches page %v", page)
+		}
+		if len(refs) == 0 {
+			break
+		}
+		for _, b := range refs {
+			branches = append(branches, b.Name)
+		}
+	}
+
+	return branches, nil
+}
+
+func (c *client) CommitInfo(ctx context.Context, owner, repo, sha string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	var cmt commitResponse
+	u := c.repoURL(owner, repo) + "/git/commits/" + url.PathEscape(sha)
+	if err := c.getJSON(ctx, u, &cmt); err != nil {
+		return nil, errors.Wrapf(err, "gitea.CommitInfo failed for %v/%v@%v", owner, repo, sha)
+	}
+
+	ri.Name = cmt.SHA
+	ri.Short = ri.Name[:12]
+	ri.Time = cmt.Commit.Committer.Date.UTC()
+	ri.Version = gdp.Pseudo(ri.Time, ri.Short)
+
+	return &ri, nil
+}
+
+func (c *client) TagInfo(ctx context.Context, owner, repo, tag string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	var tr tagResponse
+	u := c.repoURL(owner, repo) + "/tags/" + url.PathEscape(tag)
+	if err := c.getJSON(ctx, u, &tr); err != nil {
+		return nil, errors.Wrapf(err, "gitea.TagInfo failed for %v/%v@%v", owner, repo, tag)
+	}
+
+	ri.Name = tr.Commit.SHA
+	ri.Short = tag
+	ri.Version = tag
+	ri.Time = tr.Commit.Created.UTC()
+
+	return &ri, nil
+}
+
+func (c *client) LatestCommit(ctx context.Context, owner, repo string) (sha string, t time.Time, err error) {
+	var rr repoResponse
+	if err = c.getJSON(ctx, c.repoURL(owner, repo), &rr); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "gitea.getRepo")
+	}
+
+	var br branchResponse
+	u := c.repoURL(owner, repo) + "/branches/" + url.PathEscape(rr.DefaultBranch)
+	if err = c.getJSON(ctx, u, &br); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "gitea.getBranch")
+	}
+
+	return br.Commit.ID, br.Commit.Timestamp.UTC(), nil
+}
+
+func (c *client) GetModFile(ctx context.Context, owner, repo, dir, version string) ([]byte, error) {
+	u := c.repoURL(owner, repo) + "/raw/" + path.Join(dir, "go.mod") + "?ref=" + url.QueryEscape(version)
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "gitea.GetModFile")
+	}
+	defer resp.Body.Close()
+	if err := gdp.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	bts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "gitea.readAll")
+	}
+
+	return bts, nil
+}
+
+// TarURL returns the archive endpoint. It carries no credentials,
+// private repositories are downloaded through Archive instead.
+func (c *client) TarURL(ctx context.Context, owner, repo, version string) (string, error) {
+	return c.repoURL(owner, repo) + "/archive/" + url.PathEscape(version) + ".tar.gz", nil
+}
+
+// Archive downloads the tarball with the token header.
+func (c *client) Archive(ctx context.Context, owner, repo, ref string) (io.ReadCloser, gdp.ArchiveFormat, error) {
+	u, _ := c.TarURL(ctx, owner, repo, ref)
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "gitea.Archive")
+	}
+	if err := gdp.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+
+	return resp.Body, gdp.ArchiveTarGz, nil
+}
+
+func (c *client) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "token "+c.token)
+	}
+
+	resp, err := c.c.Do(req.WithContext(ctx))
+
+	return resp, gdp.Unavailable(err)
+}
+
+func (c *client) getJSON(ctx context.Context, u string, v interface{}) error {
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, "httpGet")
+	}
+	defer resp.Body.Close()
+	if err := gdp.CheckResponse(resp); err != nil {
+		return err
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "jsonDecode")
+}
+
+func (c *client) repoURL(owner, repo string) string {
+	return fmt.Sprintf(
+		"%v/api/v1/repos/%v/%v",
+		c.baseURL,
+		url.PathEscape(owner),
+		url.PathEscape(repo),
+	)
+}
+
+type tagResponse struct {
+	Name   string `json:"name"`
+	Commit struct {
+		SHA     string    `json:"sha"`
+		Created time.Time `json:"created"`
+	} `json:"commit"`
+}
+
+type branchResponse struct {
+	Name   string `json:"name"`
+	Commit struct {
+		ID        string    `json:"id"`
+		Timestamp time.Time `json:"timestamp"`
+	} `json:"commit"`
+}
+
+type commitResponse struct {
+	SHA    string `json:"sha"`
+	Commit struct {
+		Committer struct {
+			Date time.Time `json:"date"`
+		} `json:"committer"`
+	} `json:"commit"`
+}
+
+type repoResponse struct {
+	DefaultBranch string `json:"default_branch"`
+}
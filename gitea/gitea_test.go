@@ -0,0 +1,99 @@
+package gitea
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/internal/testhost"
+)
+
+const sha = testhost.SHA
+
+var ctx = context.Background()
+
+// fakeAPI stands in for the subset of the Gitea v1 API
+// used by the client, serving a single repository: owner/repo.
+func fakeAPI(t *testing.T) *httptest.Server {
+	const repo = "/api/v1/repos/owner/repo"
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		page := r.URL.Query().Get("page")
+		switch p := r.URL.Path; p {
+		case repo + "/tags":
+			if page == "1" {
+				fmt.Fprintf(w, `[{"name": "v0.2.0", "commit": {"sha": %q}}, {"name": "v0.1.0"}]`, sha)
+				return
+			}
+			fmt.Fprint(w, `[]`)
+		case repo + "/branches":
+			if page == "1" {
+				fmt.Fprint(w, `[{"name": "main"}, {"name": "dev"}]`)
+				return
+			}
+			fmt.Fprint(w, `[]`)
+		case repo + "/tags/v0.2.0":
+			fmt.Fprintf(w, `{"name": "v0.2.0", "commit": {"sha": %q, "created": "2016-09-29T01:48:01Z"}}`, sha)
+		case repo + "/git/commits/" + sha[:12]:
+			fmt.Fprintf(w, `{"sha": %q, "commit": {"committer": {"date": "2016-09-29T01:48:01Z"}}}`, sha)
+		case repo:
+			fmt.Fprint(w, `{"default_branch": "main"}`)
+		case repo + "/branches/main":
+			fmt.Fprintf(w, `{"name": "main", "commit": {"id": %q, "timestamp": "2016-09-29T01:48:01Z"}}`, sha)
+		case repo + "/raw/go.mod":
+			if r.URL.Query().Get("ref") != "v0.2.0" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, "module gitea.com/owner/repo\n")
+		case repo + "/archive/v0.2.0.tar.gz":
+			w.Write(testhost.Tarball(t, "repo/", testhost.Files("gitea.com/owner/repo")))
+		default:
+			t.Logf("unexpected path %v", p)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestProtocol(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	testhost.Run(t, gdp.New(New(srv.URL, "tok")), "gitea.com/owner/repo")
+}
+
+func TestBranches(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	branches, err := New(srv.URL, "tok").Branches(ctx, "owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"main", "dev"}
+	if !reflect.DeepEqual(branches, expected) {
+		t.Fatalf("unexpected branches %v", branches)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	info, err := gdp.New(New(srv.URL, "tok")).Latest(ctx, "gitea.com/owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Version != "v0.0.0-20160929014801-645ef00459ed" {
+		t.Fatalf("unexpected rev info %#v", info)
+	}
+}
@@ -2,7 +2,12 @@ package github
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/google/go-github/github"
@@ -12,31 +17,79 @@ import (
 )
 
 type codeHost struct {
-	c *github.Client
+	c  *github.Client
+	hc *http.Client
 }
 
 // New github implementation of the CodeHost api.
 // Use gdp.New create a download protocol out of it.
 func New(tok string) gdp.CodeHost {
-	var d codeHost
-	var client *http.Client
-	if tok != "" {
-		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok})
-		client = oauth2.NewClient(oauth2.NoContext, ts)
+	client := httpClient(tok)
+
+	return &codeHost{c: github.NewClient(client), hc: client}
+}
+
+// NewEnterprise returns the CodeHost of a GitHub Enterprise Server
+// instance. baseURL is its API url, such as
+// https://github.mycorp.com/api/v3/, and uploadURL its upload url.
+// The root of the instance, https://github.mycorp.com, stands for
+// either one, and an empty uploadURL is derived from baseURL.
+func NewEnterprise(baseURL, uploadURL, tok string) (gdp.CodeHost, error) {
+	if uploadURL == "" {
+		uploadURL = baseURL
+	}
+	baseURL, err := enterpriseURL(baseURL, "api/v3/")
+	if err != nil {
+		return nil, errors.Wrap(err, "github.NewEnterprise")
+	}
+	uploadURL, err = enterpriseURL(uploadURL, "api/uploads/")
+	if err != nil {
+		return nil, errors.Wrap(err, "github.NewEnterprise")
+	}
+	client := httpClient(tok)
+	c, err := github.NewEnterpriseClient(baseURL, uploadURL, client)
+	if err != nil {
+		return nil, errors.Wrap(err, "github.NewEnterpriseClient")
+	}
+
+	return &codeHost{c: c, hc: client}, nil
+}
+
+// enterpriseURL points rawurl at api when it's the root of the
+// instance or its v3 API, or else rawurl is used as is.
+func enterpriseURL(rawurl, api string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("%q is not an absolute url", rawurl)
 	}
+	p := strings.TrimSuffix(u.Path, "/")
+	if p == "" || strings.HasSuffix(p, "/api/v3") {
+		u.Path = strings.TrimSuffix(p, "/api/v3") + "/" + api
+	}
+
+	return u.String(), nil
+}
 
-	d.c = github.NewClient(client)
+// httpClient authenticates every request with tok, if any.
+func httpClient(tok string) *http.Client {
+	if tok == "" {
+		return http.DefaultClient
+	}
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tok})
 
-	return &d
+	return oauth2.NewClient(oauth2.NoContext, ts)
 }
 
 func (d *codeHost) Tags(ctx context.Context, owner, repo string) ([]string, error) {
 	var allTags []string
 	page := 1
 	for {
-		tags, _, err := d.c.Repositories.ListTags(ctx, owner, repo, &github.ListOptions{Page: page, PerPage: 100})
+		tags, resp, err := d.c.Repositories.ListTags(ctx, owner, repo, &github.ListOptions{Page: page, PerPage: 100})
 		if err != nil {
-			return nil, errors.Wrapf(err, "github.Tags page %v", page)
+			return nil, errors.Wrapf(check(resp, err), "github.Tags page %v", page)
 		}
 
 		if len(tags) == 0 {
@@ -57,9 +110,9 @@ func (d *codeHost) Branches(ctx context.Context, owner, repo string) ([]string,
 	branches := []string{}
 	page := 1
 	for {
-		bb, _, err := d.c.Repositories.ListBranches(ctx, owner, repo, &github.ListOptions{Page: page, PerPage: 100})
+		bb, resp, err := d.c.Repositories.ListBranches(ctx, owner, repo, &github.ListOptions{Page: page, PerPage: 100})
 		if err != nil {
-			return nil, errors.Wrapf(err, "github.Branches page %v", page)
+			return nil, errors.Wrapf(check(resp, err), "github.Branches page %v", page)
 		}
 		if len(bb) == 0 {
 			break
@@ -75,9 +128,9 @@ func (d *codeHost) Branches(ctx context.Context, owner, repo string) ([]string,
 
 func (d *codeHost) CommitInfo(ctx context.Context, owner, repo, sha string) (*gdp.RevInfo, error) {
 	var ri gdp.RevInfo
-	c, _, err := d.c.Repositories.GetCommit(ctx, owner, repo, sha)
+	c, resp, err := d.c.Repositories.GetCommit(ctx, owner, repo, sha)
 	if err != nil {
-		return nil, errors.Wrapf(err, "info.GetCommit failed for %v/%v@%v", owner, repo, sha)
+		return nil, errors.Wrapf(check(resp, err), "info.GetCommit failed for %v/%v@%v", owner, repo, sha)
 	}
 	ri.Name = c.GetSHA()
 	ri.Short = ri.Name[:12]
@@ -88,9 +141,9 @@ func (d *codeHost) CommitInfo(ctx context.Context, owner, repo, sha string) (*gd
 
 func (d *codeHost) TagInfo(ctx context.Context, owner, repo, tag string) (*gdp.RevInfo, error) {
 	var ri gdp.RevInfo
-	c, _, err := d.c.Repositories.GetCommit(ctx, owner, repo, tag)
+	c, resp, err := d.c.Repositories.GetCommit(ctx, owner, repo, tag)
 	if err != nil {
-		return nil, errors.Wrapf(err, "info.GetCommit failed for %v/%v@%v", owner, repo, tag)
+		return nil, errors.Wrapf(check(resp, err), "info.GetCommit failed for %v/%v@%v", owner, repo, tag)
 	}
 	ri.Name = c.GetSHA()
 	ri.Short = tag
@@ -100,29 +153,44 @@ func (d *codeHost) TagInfo(ctx context.Context, owner, repo, tag string) (*gdp.R
 }
 
 func (d *codeHost) LatestCommit(ctx context.Context, owner, repo string) (sha string, t time.Time, err error) {
-	r, _, err := d.c.Repositories.Get(ctx, owner, repo)
+	r, resp, err := d.c.Repositories.Get(ctx, owner, repo)
 	if err != nil {
-		return "", time.Time{}, errors.Wrap(err, "github.repoGet")
+		return "", time.Time{}, errors.Wrap(check(resp, err), "github.repoGet")
 	}
 
 	ref := r.GetDefaultBranch()
-	c, _, err := d.c.Repositories.GetCommit(ctx, owner, repo, ref)
+	c, resp, err := d.c.Repositories.GetCommit(ctx, owner, repo, ref)
 	if err != nil {
-		return "", time.Time{}, errors.Wrap(err, "github.repoGetCOmmit")
+		return "", time.Time{}, errors.Wrap(check(resp, err), "github.repoGetCOmmit")
 	}
 
 	return c.GetSHA(), c.GetCommit().GetCommitter().GetDate(), nil
 }
 
-func (d *codeHost) GetModFile(ctx context.Context, owner, repo, version string) ([]byte, error) {
-	fc, _, resp, err := d.c.Repositories.GetContents(ctx, owner, repo, "go.mod", &github.RepositoryContentGetOptions{
+// IsAncestor compares the two commits, ancestor is reachable
+// from rev when rev is ahead of it or the same commit.
+func (d *codeHost) IsAncestor(ctx context.Context, owner, repo, ancestor, rev string) (bool, error) {
+	cmp, resp, err := d.c.Repositories.CompareCommits(ctx, owner, repo, ancestor, rev)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return false, gdp.ErrNotFound
+	}
+	if err != nil {
+		return false, errors.Wrap(check(resp, err), "github.CompareCommits")
+	}
+	status := cmp.GetStatus()
+
+	return status == "ahead" || status == "identical", nil
+}
+
+func (d *codeHost) GetModFile(ctx context.Context, owner, repo, dir, version string) ([]byte, error) {
+	fc, _, resp, err := d.c.Repositories.GetContents(ctx, owner, repo, path.Join(dir, "go.mod"), &github.RepositoryContentGetOptions{
 		Ref: version,
 	})
 	if resp != nil && resp.StatusCode == http.StatusNotFound {
 		return nil, gdp.ErrNotFound
 	}
 	if err != nil {
-		return nil, errors.Wrap(err, "github.GetContents")
+		return nil, errors.Wrap(check(resp, err), "github.GetContents")
 	}
 
 	str, err := fc.GetContent()
@@ -139,8 +207,31 @@ func (d *codeHost) TarURL(ctx context.Context, owner, repo, version string) (str
 	return u, nil
 }
 
+// Archive downloads the tarball with the same client used for
+// the API so that private repositories work.
+func (d *codeHost) Archive(ctx context.Context, owner, repo, ref string) (io.ReadCloser, gdp.ArchiveFormat, error) {
+	u, err := d.getURL(ctx, owner, repo, ref)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "github.getURL")
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "github.Archive")
+	}
+	resp, err := d.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.Wrap(gdp.Unavailable(err), "github.Archive")
+	}
+	if err := gdp.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, 0, errors.Wrap(err, "github.Archive")
+	}
+
+	return resp.Body, gdp.ArchiveTarGz, nil
+}
+
 func (d *codeHost) getURL(ctx context.Context, owner, repo, ref string) (string, error) {
-	url, _, err := d.c.Repositories.GetArchiveLink(
+	url, resp, err := d.c.Repositories.GetArchiveLink(
 		ctx,
 		owner,
 		repo,
@@ -148,8 +239,46 @@ func (d *codeHost) getURL(ctx context.Context, owner, repo, ref string) (string,
 		&github.RepositoryContentGetOptions{Ref: ref},
 	)
 	if err != nil {
-		return "", errors.Wrap(err, "GetArchiveLink")
+		return "", errors.Wrap(check(resp, err), "GetArchiveLink")
 	}
 
 	return url.String(), nil
 }
+
+// check maps the error of a call to the API, given its
+// response if there was one, to the kinds of errors of gdp.
+// The error of go-github is kept, so that errors.As still
+// finds its *github.ErrorResponse or *github.RateLimitError.
+func check(resp *github.Response, err error) error {
+	var kind error
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		kind = &gdp.RateLimitError{RetryAfter: until(e.Rate.Reset.Time)}
+	case *github.AbuseRateLimitError:
+		kind = &gdp.RateLimitError{}
+		if e.RetryAfter != nil {
+			kind = &gdp.RateLimitError{RetryAfter: *e.RetryAfter}
+		}
+	case *url.Error:
+		return gdp.Unavailable(err)
+	default:
+		if resp == nil || resp.Response == nil {
+			return err
+		}
+		kind = gdp.CheckResponse(resp.Response)
+	}
+	if kind == nil {
+		return err
+	}
+
+	return gdp.WithKind(kind, err)
+}
+
+// until is how long until t, rounded to the second.
+func until(t time.Time) time.Duration {
+	if d := time.Until(t).Round(time.Second); d > 0 {
+		return d
+	}
+
+	return 0
+}
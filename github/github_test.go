@@ -4,12 +4,20 @@ import (
 	"archive/zip"
 	"bytes"
 	"context"
+	"encoding/base64"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/google/go-github/github"
 	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/internal/testhost"
+	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 )
 
@@ -106,3 +114,135 @@ func TestZip(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// fakeEnterprise stands in for the subset of the GitHub Enterprise
+// Server API used by the client, serving a single repository:
+// owner/repo, whose tarball is served from the codeload path.
+func fakeEnterprise(t *testing.T) *httptest.Server {
+	const repo = "/api/v3/repos/owner/repo"
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		page := r.URL.Query().Get("page")
+		switch p := r.URL.Path; p {
+		case repo + "/tags":
+			if page == "1" {
+				fmt.Fprintf(w, `[{"name": "v0.2.0", "commit": {"sha": %q}}, {"name": "v0.1.0"}]`, testhost.SHA)
+				return
+			}
+			fmt.Fprint(w, `[]`)
+		case repo + "/commits/v0.2.0", repo + "/commits/" + testhost.SHA[:12]:
+			fmt.Fprintf(w, `{"sha": %q, "commit": {"committer": {"date": "2016-09-29T01:48:01Z"}}}`, testhost.SHA)
+		case repo + "/contents/go.mod":
+			if r.URL.Query().Get("ref") != "v0.2.0" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			content := base64.StdEncoding.EncodeToString([]byte("module github.mycorp.com/owner/repo\n"))
+			fmt.Fprintf(w, `{"type": "file", "encoding": "base64", "content": %q}`, content)
+		case repo + "/tarball/v0.2.0":
+			http.Redirect(w, r, srv.URL+"/_codeload/owner/repo/legacy.tar.gz/v0.2.0", http.StatusFound)
+		case "/_codeload/owner/repo/legacy.tar.gz/v0.2.0":
+			w.Write(testhost.Tarball(t, "owner-repo-645ef00/", testhost.Files("github.mycorp.com/owner/repo")))
+		default:
+			t.Logf("unexpected path %v", p)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return srv
+}
+
+func TestEnterprise(t *testing.T) {
+	srv := fakeEnterprise(t)
+	defer srv.Close()
+	ch, err := NewEnterprise(srv.URL, "", "tok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	const module = "github.mycorp.com/owner/repo"
+	ghe := gdp.New(ch)
+
+	testhost.Run(t, ghe, module)
+
+	_, err = ghe.Info(ctx, "github.mycorp.com/owner/missing", "v0.2.0")
+	if err == nil {
+		t.Fatal("expected an error for a missing repository")
+	}
+}
+
+func TestEnterpriseURLs(t *testing.T) {
+	for _, tc := range []struct {
+		baseURL, uploadURL string
+		api, upload        string
+	}{
+		{"https://github.mycorp.com", "", "https://github.mycorp.com/api/v3/", "https://github.mycorp.com/api/uploads/"},
+		{"https://github.mycorp.com/api/v3", "", "https://github.mycorp.com/api/v3/", "https://github.mycorp.com/api/uploads/"},
+		{"https://ghe.mycorp.com/github/api/v3/", "", "https://ghe.mycorp.com/github/api/v3/", "https://ghe.mycorp.com/github/api/uploads/"},
+		{"https://api.mycorp.com/v3", "https://uploads.mycorp.com/", "https://api.mycorp.com/v3/", "https://uploads.mycorp.com/api/uploads/"},
+	} {
+		ch, err := NewEnterprise(tc.baseURL, tc.uploadURL, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := ch.(*codeHost).c
+		if c.BaseURL.String() != tc.api || c.UploadURL.String() != tc.upload {
+			t.Fatalf("unexpected urls %v and %v for %v", c.BaseURL, c.UploadURL, tc.baseURL)
+		}
+	}
+
+	if _, err := NewEnterprise("github.mycorp.com", "", ""); err == nil {
+		t.Fatal("expected an error for a url without a scheme")
+	}
+}
+
+func TestErrors(t *testing.T) {
+	reset := time.Now().Add(time.Minute).Unix()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/repos/owner/limited/tags":
+			w.Header().Set("X-RateLimit-Limit", "5000")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "API rate limit exceeded for user ID 1."}`)
+		case "/api/v3/repos/owner/abused/tags":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message": "You have triggered an abuse detection mechanism.", "documentation_url": "https://developer.github.com/v3/#abuse-rate-limits"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+		}
+	}))
+	defer srv.Close()
+
+	for repo, retryAfter := range map[string]time.Duration{"limited": time.Minute, "abused": 30 * time.Second} {
+		ch, err := NewEnterprise(srv.URL, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ch.Tags(context.Background(), "owner", repo)
+		var rle *gdp.RateLimitError
+		if !errors.Is(err, gdp.ErrRateLimited) || !errors.As(err, &rle) {
+			t.Fatalf("%v: expected a rate limit error but got %v", repo, err)
+		}
+		if d := rle.RetryAfter - retryAfter; d < -2*time.Second || d > 0 {
+			t.Fatalf("%v: unexpected retry after %v", repo, rle.RetryAfter)
+		}
+	}
+
+	ch, err := NewEnterprise(srv.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ch.Tags(context.Background(), "owner", "missing")
+	var ger *github.ErrorResponse
+	if !errors.Is(err, gdp.ErrNotFound) || !errors.As(err, &ger) || ger.Message != "Not Found" {
+		t.Fatalf("expected ErrNotFound with the github error but got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package gitlab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+)
+
+// DefaultURL is the base URL of gitlab.com
+const DefaultURL = "https://gitlab.com"
+
+// New returns a GitLab implementation of the CodeHost api
+// that talks to the v4 REST API found at baseURL. An empty
+// baseURL means gitlab.com, and tok is an optional private token.
+// Use gdp.New to create a download protocol out of it.
+func New(baseURL, tok string) gdp.CodeHost {
+	if baseURL == "" {
+		baseURL = DefaultURL
+	}
+
+	return &client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   tok,
+		c:       http.DefaultClient,
+	}
+}
+
+type client struct {
+	baseURL string
+	token   string
+	c       *http.Client
+}
+
+// SplitModule maps host/group/repo/dir to the group/repo project.
+// A project in a subgroup can't be told apart from a directory
+// without asking GitLab, so like cmd/go, its module path ends the
+// project path with .git, as in gitlab.com/group/subgroup/repo.git,
+// and owner is then the full path of its group.
+func (c *client) SplitModule(module string) (owner, repo, dir string, err error) {
+	els := strings.Split(module, "/")
+	for i := 2; i < len(els); i++ {
+		if repo := strings.TrimSuffix(els[i], ".git"); repo != els[i] && repo != "" {
+			return strings.Join(els[1:i], "/"), repo, strings.Join(els[i+1:], "/"), nil
+		}
+	}
+
+	return gdp.SplitModule(module)
+}
+
+func (c *client) Tags(ctx context.Context, owner, repo string) ([]string, error) {
+	var tags []refResponse
+	if err := c.getPages(ctx, c.projectURL(owner, repo)+"/repository/tags", &tags); err != nil {
+		return nil, errors.Wrap(err, "gitlab.Tags")
+	}
+	names := []string{}
+	for _, t := range tags {
+		names = append(names, t.Name)
+	}
+
+	return names, nil
+}
+
+func (c *client) Branches(ctx context.Context, owner, repo string) ([]string, error) {
+	var branches []refResponse
+	if err := c.getPages(ctx, c.projectURL(owner, repo)+"/repository/branches", &branches); err != nil {
+		return nil, errors.Wrap(err, "gitlab.Branches")
+	}
+	names := []string{}
+	for _, b := range branches {
+		names = append(names, b.Name)
+	}
+
+	return names, nil
+}
+
+func (c *client) CommitInfo(ctx context.Context, owner, repo, sha string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	var cmt commit
+	u := c.projectURL(owner, repo) + "/repository/commits/" + url.PathEscape(sha)
+	if err := c.getJSON(ctx, u, &cmt); err != nil {
+		return nil, errors.Wrapf(err, "gitlab.CommitInfo failed for %v/%v@%v", owner, repo, sha)
+	}
+
+	ri.Name = cmt.ID
+	ri.Short = ri.Name[:12]
+	ri.Time = cmt.CommittedDate.UTC()
+	ri.Version = gdp.Pseudo(ri.Time, ri.Short)
+
+	return &ri, nil
+}
+
+func (c *client) TagInfo(ctx context.Context, owner, repo, tag string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	var tr refResponse
+	u := c.projectURL(owner, repo) + "/repository/tags/" + url.PathEscape(tag)
+	if err := c.getJSON(ctx, u, &tr); err != nil {
+		return nil, errors.Wrapf(err, "gitlab.TagInfo failed for %v/%v@%v", owner, repo, tag)
+	}
+
+	ri.Name = tr.Commit.ID
+	ri.Short = tag
+	ri.Version = tag
+	ri.Time = tr.Commit.CommittedDate.UTC()
+
+	return &ri, nil
+}
+
+func (c *client) LatestCommit(ctx context.Context, owner, repo string) (sha string, t time.Time, err error) {
+	var pr projectResponse
+	if err = c.getJSON(ctx, c.projectURL(owner, repo), &pr); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "gitlab.getProject")
+	}
+
+	var br refResponse
+	u := c.projectURL(owner, repo) + "/repository/branches/" + url.PathEscape(pr.DefaultBranch)
+	if err = c.getJSON(ctx, u, &br); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "gitlab.getBranch")
+	}
+
+	return br.Commit.ID, br.Commit.CommittedDate.UTC(), nil
+}
+
+// IsAncestor compares rev to ancestor from their merge base,
+// which is ancestor itself when there is nothing to compare.
+func (c *client) IsAncestor(ctx context.Context, owner, repo, ancestor, rev string) (bool, error) {
+	q := url.Values{}
+	q.Set("from", rev)
+	q.Set("to", ancestor)
+	var cr compareResponse
+	if err := c.getJSON(ctx, c.projectURL(owner, repo)+"/repository/compare?"+q.Encode(), &cr); err != nil {
+		return false, errors.Wrap(err, "gitlab.IsAncestor")
+	}
+
+	return len(cr.Commits) == 0, nil
+}
+
+func (c *client) GetModFile(ctx context.Context, owner, repo, dir, version string) ([]byte, error) {
+	file := url.PathEscape(path.Join(dir, "go.mod"))
+	u := c.projectURL(owner, repo) + "/repository/files/" + file + "/raw?ref=" + url.QueryEscape(version)
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "gitlab.GetModFile")
+	}
+	defer resp.Body.Close()
+	if err := gdp.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	bts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "gitlab.readAll")
+	}
+
+	return bts, nil
+}
+
+// TarURL returns the archive endpoint. It carries no credentials,
+// private projects are downloaded through Archive instead.
+func (c *client) TarURL(ctx context.Context, owner, repo, version string) (string, error) {
+	q := url.Values{}
+	q.Set("sha", version)
+
+	return c.projectURL(owner, repo) + "/repository/archive.tar.gz?" + q.Encode(), nil
+}
+
+// Archive downloads the tarball with the private token header.
+func (c *client) Archive(ctx context.Context, owner, repo, ref string) (io.ReadCloser, gdp.ArchiveFormat, error) {
+	u, _ := c.TarURL(ctx, owner, repo, ref)
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "gitlab.Archive")
+	}
+	if err := gdp.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, 0, err
+	}
+
+	return resp.Body, gdp.ArchiveTarGz, nil
+}
+
+func (c *client) get(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("PRIVATE-TOKEN", c.token)
+	}
+
+	resp, err := c.c.Do(req.WithContext(ctx))
+
+	return resp, gdp.Unavailable(err)
+}
+
+func (c *client) getJSON(ctx context.Context, u string, v interface{}) error {
+	resp, err := c.get(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, "httpGet")
+	}
+	defer resp.Body.Close()
+	if err := gdp.CheckResponse(resp); err != nil {
+		return err
+	}
+
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(v), "jsonDecode")
+}
+
+// getPages follows the X-Next-Page header until all pages
+// of a list endpoint have been appended to v.
+func (c *client) getPages(ctx context.Context, u string, v *[]refResponse) error {
+	page := "1"
+	for page != "" {
+		resp, err := c.get(ctx, u+"?per_page=100&page="+page)
+		if err != nil {
+			return errors.Wrapf(err, "httpGet page %v", page)
+		}
+		if err := gdp.CheckResponse(resp); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		var refs []refResponse
+		err = json.NewDecoder(resp.Body).Decode(&refs)
+		resp.Body.Close()
+		if err != nil {
+			return errors.Wrapf(err, "jsonDecode page %v", page)
+		}
+		*v = append(*v, refs...)
+		page = resp.Header.Get("X-Next-Page")
+	}
+
+	return nil
+}
+
+// projectURL returns the API url of a project. GitLab accepts
+// the URL-encoded "owner/repo" path in place of a numeric id,
+// where owner may be a group with subgroups.
+func (c *client) projectURL(owner, repo string) string {
+	return fmt.Sprintf(
+		"%v/api/v4/projects/%v",
+		c.baseURL,
+		url.PathEscape(owner+"/"+repo),
+	)
+}
+
+type commit struct {
+	ID            string    `json:"id"`
+	CommittedDate time.Time `json:"committed_date"`
+}
+
+type refResponse struct {
+	Name   string `json:"name"`
+	Commit commit `json:"commit"`
+}
+
+type projectResponse struct {
+	DefaultBranch string `json:"default_branch"`
+}
+
+type compareResponse struct {
+	Commits []commit `json:"commits"`
+}
@@ -0,0 +1,119 @@
+package gitlab
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/internal/testhost"
+)
+
+const sha = testhost.SHA
+
+var ctx = context.Background()
+
+// fakeAPI stands in for the subset of the GitLab v4 API
+// used by the client, serving a single project: owner/repo.
+func fakeAPI(t *testing.T) *httptest.Server {
+	const project = "/api/v4/projects/owner%2Frepo"
+	cmt := fmt.Sprintf(`{"id": %q, "committed_date": "2016-09-29T01:48:01.000Z"}`, sha)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch p := r.URL.EscapedPath(); p {
+		case project + "/repository/tags":
+			if r.URL.Query().Get("page") == "1" {
+				w.Header().Set("X-Next-Page", "2")
+				fmt.Fprint(w, `[{"name": "v0.2.0"}, {"name": "notsemver"}]`)
+				return
+			}
+			fmt.Fprint(w, `[{"name": "v0.1.0"}]`)
+		case project + "/repository/tags/v0.2.0":
+			fmt.Fprintf(w, `{"name": "v0.2.0", "commit": %v}`, cmt)
+		case project + "/repository/tags/v0.1.0":
+			fmt.Fprint(w, `{"name": "v0.1.0", "commit": {"id": "1111111111111111111111111111111111111111", "committed_date": "2016-09-01T00:00:00.000Z"}}`)
+		case project + "/repository/commits/" + sha[:12]:
+			fmt.Fprint(w, cmt)
+		case project:
+			fmt.Fprint(w, `{"default_branch": "main"}`)
+		case project + "/repository/branches/main":
+			fmt.Fprintf(w, `{"name": "main", "commit": %v}`, cmt)
+		case project + "/repository/compare":
+			// v0.2.0 was tagged on another branch.
+			if r.URL.Query().Get("to") == "v0.2.0" {
+				fmt.Fprintf(w, `{"commits": [%v]}`, cmt)
+				return
+			}
+			fmt.Fprint(w, `{"commits": []}`)
+		case project + "/repository/files/go.mod/raw":
+			if r.URL.Query().Get("ref") != "v0.2.0" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, "module gitlab.com/owner/repo\n")
+		case project + "/repository/archive.tar.gz":
+			w.Write(testhost.Tarball(t, "repo-"+r.URL.Query().Get("sha")+"/", testhost.Files("gitlab.com/owner/repo")))
+		default:
+			t.Logf("unexpected path %v", p)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestSplitModule(t *testing.T) {
+	c := New("", "").(*client)
+	for path, expected := range map[string][3]string{
+		"gitlab.com/owner/repo":                     {"owner", "repo", ""},
+		"gitlab.com/owner/repo/sub":                 {"owner", "repo", "sub"},
+		"gitlab.com/group/subgroup/repo.git":        {"group/subgroup", "repo", ""},
+		"gitlab.com/group/subgroup/repo.git/sub/v2": {"group/subgroup", "repo", "sub/v2"},
+	} {
+		owner, repo, dir, err := c.SplitModule(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if [3]string{owner, repo, dir} != expected {
+			t.Fatalf("unexpected split %v %v %v of %v", owner, repo, dir, path)
+		}
+	}
+
+	if u := c.projectURL("group/subgroup", "repo"); u != DefaultURL+"/api/v4/projects/group%2Fsubgroup%2Frepo" {
+		t.Fatalf("unexpected url of a project in a subgroup %v", u)
+	}
+}
+
+func TestProtocol(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	testhost.Run(t, gdp.New(New(srv.URL, "tok")), "gitlab.com/owner/repo")
+}
+
+func TestLatest(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	info, err := gdp.New(New(srv.URL, "tok")).Latest(ctx, "gitlab.com/owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Version != "v0.1.1-0.20160929014801-645ef00459ed" {
+		t.Fatalf("unexpected rev info %#v", info)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	srv := fakeAPI(t)
+	defer srv.Close()
+
+	_, err := gdp.New(New(srv.URL, "")).List(ctx, "gitlab.com/owner/repo")
+	if err == nil {
+		t.Fatal("expected an error without a token")
+	}
+}
@@ -0,0 +1,669 @@
+package gitsmart
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+)
+
+// New returns a CodeHost that speaks the git smart HTTP
+// protocol (version 2) directly, so it works against any
+// plain git server without a vendor API. Repositories are
+// fetched from baseURL/owner/repo. Use gdp.New to create
+// a download protocol out of it.
+func New(baseURL string) gdp.CodeHost {
+	return &client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		c:       http.DefaultClient,
+		caps:    map[string]capabilities{},
+	}
+}
+
+type client struct {
+	baseURL string
+	c       *http.Client
+
+	mu   sync.Mutex
+	caps map[string]capabilities
+	hist *history
+}
+
+// history is the commit graph of rev, which IsAncestor keeps
+// since it's asked about the same rev for one tag after another.
+type history struct {
+	u, rev  string
+	parents map[string][]string
+}
+
+func (c *client) Tags(ctx context.Context, owner, repo string) ([]string, error) {
+	refs, err := c.lsRefs(ctx, c.repoURL(owner, repo), "refs/tags/")
+	if err != nil {
+		return nil, errors.Wrap(err, "gitsmart.Tags")
+	}
+	tags := []string{}
+	for _, r := range refs {
+		tags = append(tags, strings.TrimPrefix(r.name, "refs/tags/"))
+	}
+
+	return tags, nil
+}
+
+func (c *client) Branches(ctx context.Context, owner, repo string) ([]string, error) {
+	refs, err := c.lsRefs(ctx, c.repoURL(owner, repo), "refs/heads/")
+	if err != nil {
+		return nil, errors.Wrap(err, "gitsmart.Branches")
+	}
+	branches := []string{}
+	for _, r := range refs {
+		branches = append(branches, strings.TrimPrefix(r.name, "refs/heads/"))
+	}
+
+	return branches, nil
+}
+
+func (c *client) CommitInfo(ctx context.Context, owner, repo, sha string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	u := c.repoURL(owner, repo)
+	id, err := c.resolve(ctx, u, sha)
+	if err != nil {
+		return nil, errors.Wrapf(err, "gitsmart.CommitInfo failed for %v/%v@%v", owner, repo, sha)
+	}
+	t, err := c.commitTime(ctx, u, id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "gitsmart.CommitInfo failed for %v/%v@%v", owner, repo, sha)
+	}
+
+	ri.Name = id
+	ri.Short = ri.Name[:12]
+	ri.Time = t
+	ri.Version = gdp.Pseudo(ri.Time, ri.Short)
+
+	return &ri, nil
+}
+
+func (c *client) TagInfo(ctx context.Context, owner, repo, tag string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	u := c.repoURL(owner, repo)
+	refs, err := c.lsRefs(ctx, u, "refs/tags/"+tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "gitsmart.TagInfo failed for %v/%v@%v", owner, repo, tag)
+	}
+	var id string
+	for _, r := range refs {
+		if r.name == "refs/tags/"+tag {
+			id = r.commit()
+		}
+	}
+	if id == "" {
+		return nil, gdp.ErrNotFound
+	}
+	t, err := c.commitTime(ctx, u, id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "gitsmart.TagInfo failed for %v/%v@%v", owner, repo, tag)
+	}
+
+	ri.Name = id
+	ri.Short = tag
+	ri.Version = tag
+	ri.Time = t
+
+	return &ri, nil
+}
+
+func (c *client) LatestCommit(ctx context.Context, owner, repo string) (sha string, t time.Time, err error) {
+	u := c.repoURL(owner, repo)
+	refs, err := c.lsRefs(ctx, u, "HEAD")
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "gitsmart.lsRefs")
+	}
+	for _, r := range refs {
+		if r.name == "HEAD" {
+			sha = r.id
+		}
+	}
+	if sha == "" {
+		return "", time.Time{}, gdp.ErrNotFound
+	}
+	t, err = c.commitTime(ctx, u, sha)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "gitsmart.commitTime")
+	}
+
+	return sha, t, nil
+}
+
+// IsAncestor fetches the commit history of rev, without trees
+// when the server supports filtering, and walks it for ancestor.
+// The history of the last rev is reused by the next call.
+func (c *client) IsAncestor(ctx context.Context, owner, repo, ancestor, rev string) (bool, error) {
+	u := c.repoURL(owner, repo)
+	a, err := c.resolve(ctx, u, ancestor)
+	if err != nil {
+		return false, errors.Wrap(err, "gitsmart.IsAncestor")
+	}
+	r, err := c.resolve(ctx, u, rev)
+	if err != nil {
+		return false, errors.Wrap(err, "gitsmart.IsAncestor")
+	}
+	parents, err := c.history(ctx, u, r)
+	if err != nil {
+		return false, errors.Wrap(err, "gitsmart.IsAncestor")
+	}
+
+	seen := map[string]bool{}
+	queue := []string{r}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if id == a {
+			return true, nil
+		}
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		p, ok := parents[id]
+		if !ok {
+			return false, fmt.Errorf("gitsmart.IsAncestor: commit %v not found in pack", id)
+		}
+		queue = append(queue, p...)
+	}
+
+	return false, nil
+}
+
+// history returns the parents of every commit reachable
+// from the full commit hash rev.
+func (c *client) history(ctx context.Context, u, rev string) (map[string][]string, error) {
+	c.mu.Lock()
+	h := c.hist
+	c.mu.Unlock()
+	if h != nil && h.u == u && h.rev == rev {
+		return h.parents, nil
+	}
+
+	caps, err := c.capabilities(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	filter := ""
+	if caps.fetch("filter") {
+		filter = "tree:0"
+	}
+	st, err := c.fetch(ctx, u, []string{rev}, false, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer st.close()
+	parents := map[string][]string{}
+	for id, o := range st.objs {
+		if o.typ != objCommit {
+			continue
+		}
+		cmt, err := parseCommit(o.data)
+		if err != nil {
+			return nil, err
+		}
+		parents[id] = cmt.parents
+	}
+
+	c.mu.Lock()
+	c.hist = &history{u: u, rev: rev, parents: parents}
+	c.mu.Unlock()
+
+	return parents, nil
+}
+
+// GetModFile fetches the trees of version without their blobs
+// when the server supports filtering and then just the go.mod
+// blob, instead of the whole tree of version.
+func (c *client) GetModFile(ctx context.Context, owner, repo, dir, version string) ([]byte, error) {
+	u := c.repoURL(owner, repo)
+	caps, err := c.capabilities(ctx, u)
+	if err != nil {
+		return nil, errors.Wrap(err, "gitsmart.GetModFile")
+	}
+	filter := ""
+	if caps.fetch("filter") {
+		filter = "blob:none"
+	}
+	st, cmt, err := c.snapshot(ctx, u, version, filter)
+	if err != nil {
+		return nil, errors.Wrap(err, "gitsmart.GetModFile")
+	}
+	defer st.close()
+	id, ok, err := st.lookup(cmt.tree, path.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, errors.Wrap(err, "gitsmart.GetModFile")
+	} else if !ok {
+		return nil, gdp.ErrNotFound
+	}
+	if filter != "" {
+		blobs, err := c.fetch(ctx, u, []string{id}, false, "")
+		if err != nil {
+			return nil, errors.Wrap(err, "gitsmart.GetModFile")
+		}
+		defer blobs.close()
+		st = blobs
+	}
+	bts, err := st.blob(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "gitsmart.GetModFile")
+	}
+
+	return bts, nil
+}
+
+// TarURL is not supported because a git server has no archive
+// endpoint, archives are produced by Archive instead.
+func (c *client) TarURL(ctx context.Context, owner, repo, version string) (string, error) {
+	return "", errors.New("gitsmart: no tarball url, use Archive")
+}
+
+// Archive fetches the tree at ref and streams it as a tar.gz
+// archive with a single top level directory, like GitHub's.
+func (c *client) Archive(ctx context.Context, owner, repo, ref string) (io.ReadCloser, gdp.ArchiveFormat, error) {
+	st, cmt, err := c.snapshot(ctx, c.repoURL(owner, repo), ref, "")
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "gitsmart.Archive")
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer st.close()
+		gw := gzip.NewWriter(pw)
+		tw := tar.NewWriter(gw)
+		dir := repo + "/"
+		err := tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755, ModTime: cmt.time})
+		if err == nil {
+			err = writeTree(tw, st, cmt, dir, cmt.tree)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil {
+			err = gw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr, gdp.ArchiveTarGz, nil
+}
+
+func writeTree(tw *tar.Writer, st *store, cmt *commit, dir, id string) error {
+	entries, err := st.tree(id)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := dir + e.name
+		switch e.mode {
+		case "40000":
+			if err := tw.WriteHeader(&tar.Header{Name: name + "/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: cmt.time}); err != nil {
+				return err
+			}
+			if err := writeTree(tw, st, cmt, name+"/", e.id); err != nil {
+				return err
+			}
+		case "100644", "100755", "120000":
+			o, ok := st.objs[e.id]
+			if !ok || o.typ != objBlob {
+				return fmt.Errorf("blob %v not found in pack", e.id)
+			}
+			h := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: o.size, ModTime: cmt.time}
+			if e.mode == "100755" {
+				h.Mode = 0755
+			}
+			if e.mode == "120000" {
+				target, err := st.read(o)
+				if err != nil {
+					return err
+				}
+				h.Typeflag, h.Linkname, h.Size = tar.TypeSymlink, string(target), 0
+			}
+			if err := tw.WriteHeader(h); err != nil {
+				return err
+			}
+			if h.Typeflag == tar.TypeReg {
+				if _, err := io.Copy(tw, st.open(o)); err != nil {
+					return err
+				}
+			}
+		}
+		// gitlinks (160000) point at submodules which are not part of the tree.
+	}
+
+	return nil
+}
+
+func (c *client) repoURL(owner, repo string) string {
+	if owner == "" {
+		return c.baseURL + "/" + repo
+	}
+
+	return c.baseURL + "/" + owner + "/" + repo
+}
+
+// commitTime fetches just the commit object of id, without
+// its tree when the server supports filtering, and returns
+// its committer time.
+func (c *client) commitTime(ctx context.Context, u, id string) (time.Time, error) {
+	caps, err := c.capabilities(ctx, u)
+	if err != nil {
+		return time.Time{}, err
+	}
+	filter := ""
+	if caps.fetch("filter") {
+		filter = "tree:0"
+	}
+	st, err := c.fetch(ctx, u, []string{id}, true, filter)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer st.close()
+	cmt, err := st.commit(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return cmt.time, nil
+}
+
+// snapshot fetches the tree of rev without any history,
+// leaving out the objects filter leaves out. The returned
+// store must be closed.
+func (c *client) snapshot(ctx context.Context, u, rev, filter string) (*store, *commit, error) {
+	id, err := c.resolve(ctx, u, rev)
+	if err != nil {
+		return nil, nil, err
+	}
+	st, err := c.fetch(ctx, u, []string{id}, true, filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmt, err := st.commit(id)
+	if err != nil {
+		st.close()
+		return nil, nil, err
+	}
+
+	return st, cmt, nil
+}
+
+// resolve turns a branch, tag, full or abbreviated commit
+// hash into a full commit hash. Abbreviated hashes that aren't
+// a ref tip require fetching the commit history, which is kept
+// to commits only when the server supports filtering.
+func (c *client) resolve(ctx context.Context, u, rev string) (string, error) {
+	if len(rev) == 40 && isHex(rev) {
+		return rev, nil
+	}
+	refs, err := c.lsRefs(ctx, u, "refs/heads/", "refs/tags/")
+	if err != nil {
+		return "", err
+	}
+	for _, r := range refs {
+		if r.name == "refs/tags/"+rev || r.name == "refs/heads/"+rev {
+			return r.commit(), nil
+		}
+	}
+	if len(rev) < 7 || !isHex(rev) {
+		return "", gdp.ErrNotFound
+	}
+	tips := map[string]bool{}
+	for _, r := range refs {
+		if strings.HasPrefix(r.commit(), rev) {
+			return r.commit(), nil
+		}
+		tips[r.commit()] = true
+	}
+
+	caps, err := c.capabilities(ctx, u)
+	if err != nil {
+		return "", err
+	}
+	filter := ""
+	if caps.fetch("filter") {
+		filter = "tree:0"
+	}
+	wants := []string{}
+	for id := range tips {
+		wants = append(wants, id)
+	}
+	st, err := c.fetch(ctx, u, wants, false, filter)
+	if err != nil {
+		return "", err
+	}
+	defer st.close()
+	var match string
+	for id, o := range st.objs {
+		if o.typ != objCommit || !strings.HasPrefix(id, rev) {
+			continue
+		}
+		if match != "" {
+			return "", fmt.Errorf("ambiguous commit hash %v", rev)
+		}
+		match = id
+	}
+	if match == "" {
+		return "", gdp.ErrNotFound
+	}
+
+	return match, nil
+}
+
+type ref struct {
+	id     string
+	name   string
+	peeled string
+}
+
+// commit returns the commit a ref points at,
+// peeling annotated tags.
+func (r ref) commit() string {
+	if r.peeled != "" {
+		return r.peeled
+	}
+
+	return r.id
+}
+
+func (c *client) lsRefs(ctx context.Context, u string, prefixes ...string) ([]ref, error) {
+	if _, err := c.capabilities(ctx, u); err != nil {
+		return nil, err
+	}
+	var req pktWriter
+	req.line("command=ls-refs")
+	req.delim()
+	req.line("peel")
+	for _, p := range prefixes {
+		req.line("ref-prefix %v", p)
+	}
+	req.flush()
+
+	body, err := c.command(ctx, u, &req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	lines, err := readLines(bufio.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "ls-refs")
+	}
+
+	var refs []ref
+	for _, l := range lines {
+		fields := strings.Split(l, " ")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("malformed ls-refs line %q", l)
+		}
+		r := ref{id: fields[0], name: fields[1]}
+		for _, attr := range fields[2:] {
+			if strings.HasPrefix(attr, "peeled:") {
+				r.peeled = strings.TrimPrefix(attr, "peeled:")
+			}
+		}
+		refs = append(refs, r)
+	}
+
+	return refs, nil
+}
+
+// fetch asks for a packfile containing wants. shallow limits
+// the history to the wanted commits and filter, if not empty,
+// is passed as an object filter such as "tree:0". The returned
+// store must be closed.
+func (c *client) fetch(ctx context.Context, u string, wants []string, shallow bool, filter string) (*store, error) {
+	var req pktWriter
+	req.line("command=fetch")
+	req.delim()
+	req.line("no-progress")
+	req.line("ofs-delta")
+	if shallow {
+		req.line("deepen 1")
+	}
+	if filter != "" {
+		req.line("filter %v", filter)
+	}
+	for _, w := range wants {
+		req.line("want %v", w)
+	}
+	req.line("done")
+	req.flush()
+
+	body, err := c.command(ctx, u, &req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	r := bufio.NewReader(body)
+	for {
+		header, err := readPkt(r)
+		if err == errFlush {
+			return nil, errors.New("fetch: response has no packfile")
+		} else if err != nil {
+			return nil, errors.Wrap(err, "fetch")
+		}
+		if string(header) == "packfile\n" {
+			break
+		}
+		// skip sections such as shallow-info up to their delim-pkt.
+		if _, err := readLines(r); err != nil {
+			return nil, errors.Wrap(err, "fetch")
+		}
+	}
+
+	// the pack is parsed straight off the response
+	// instead of being held in memory first.
+	return parsePack(&sideband{r: r})
+}
+
+type capabilities map[string]string
+
+// fetch reports whether the fetch command supports feature.
+func (c capabilities) fetch(feature string) bool {
+	for _, f := range strings.Fields(c["fetch"]) {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// capabilities returns the capabilities the server advertises
+// for the repository at u, which are fetched once per repository
+// rather than per command.
+func (c *client) capabilities(ctx context.Context, u string) (capabilities, error) {
+	c.mu.Lock()
+	caps := c.caps[u]
+	c.mu.Unlock()
+	if caps != nil {
+		return caps, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := c.c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(gdp.Unavailable(err), "info/refs")
+	}
+	defer resp.Body.Close()
+	if err := gdp.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(resp.Body)
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "info/refs")
+	}
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "# service=") {
+		lines, err = readLines(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "info/refs")
+		}
+	}
+	if len(lines) == 0 || lines[0] != "version 2" {
+		return nil, errors.New(u + " does not support git protocol version 2")
+	}
+	caps = capabilities{}
+	for _, l := range lines[1:] {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		caps[kv[0]] = kv[1]
+	}
+	c.mu.Lock()
+	c.caps[u] = caps
+	c.mu.Unlock()
+
+	return caps, nil
+}
+
+// command sends a protocol v2 command and returns the response body.
+func (c *client) command(ctx context.Context, u string, body *pktWriter) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodPost, u+"/git-upload-pack", bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Accept", "application/x-git-upload-pack-result")
+	req.Header.Set("Git-Protocol", "version=2")
+	resp, err := c.c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(gdp.Unavailable(err), "git-upload-pack")
+	}
+	if err := gdp.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, errors.Wrap(err, "git-upload-pack")
+	}
+
+	return resp.Body, nil
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
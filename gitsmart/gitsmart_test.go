@@ -0,0 +1,342 @@
+package gitsmart
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+)
+
+var ctx = context.Background()
+
+// gitServer creates owner/repo.git with an untagged commit
+// followed by two tagged ones and serves it through git
+// http-backend, the CGI program that fronts most self-hosted
+// git servers.
+func gitServer(t *testing.T) (srv *httptest.Server, commits []string) {
+	t.Helper()
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	root, err := ioutil.TempDir("", "gitsmart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(root, "work")
+	bare := filepath.Join(root, "owner", "repo.git")
+
+	git(t, "", "init", "-q", work)
+	// a large, repetitive file makes git store the second
+	// revision as a delta of the first.
+	big := strings.Repeat("package repo // padding\n", 500)
+	write(t, work, "go.mod", "module example.com/owner/repo\n")
+	write(t, work, "repo.go", big)
+	commits = append(commits, commitAll(t, work, "2018-03-11T21:45:15Z"))
+
+	write(t, work, "sub/sub.go", "package sub\n")
+	commits = append(commits, commitAll(t, work, "2018-03-11T22:00:00Z"))
+	git(t, work, "tag", "v0.1.0")
+
+	write(t, work, "repo.go", big+"// more\n")
+	os.Symlink("repo.go", filepath.Join(work, "link.go"))
+	commits = append(commits, commitAll(t, work, "2018-03-12T10:00:00Z"))
+	git(t, work, "tag", "-a", "-m", "release", "v0.2.0")
+	git(t, "", "clone", "-q", "--bare", work, bare)
+	git(t, bare, "repack", "-q", "-a", "-d", "-f")
+	git(t, bare, "config", "uploadpack.allowFilter", "true")
+
+	srv = httptest.NewServer(&cgi.Handler{
+		Path: filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend"),
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	t.Cleanup(func() {
+		srv.Close()
+		os.RemoveAll(root)
+	})
+
+	return srv, commits
+}
+
+var gitEnv = append(
+	os.Environ(),
+	"GIT_CONFIG_NOSYSTEM=1",
+	"HOME="+os.TempDir(),
+	"GIT_AUTHOR_NAME=gdp",
+	"GIT_AUTHOR_EMAIL=gdp@example.com",
+	"GIT_COMMITTER_NAME=gdp",
+	"GIT_COMMITTER_EMAIL=gdp@example.com",
+)
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	return gitWithEnv(t, dir, nil, args...)
+}
+
+func gitWithEnv(t *testing.T, dir string, env []string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append([]string{}, gitEnv...), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func write(t *testing.T, dir, name, content string) {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	os.MkdirAll(filepath.Dir(p), 0755)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commitAll(t *testing.T, work, date string) string {
+	t.Helper()
+	git(t, work, "add", "-A")
+	gitWithEnv(t, work, []string{"GIT_AUTHOR_DATE=" + date, "GIT_COMMITTER_DATE=" + date}, "commit", "-q", "-m", date)
+
+	return git(t, work, "rev-parse", "HEAD")
+}
+
+func TestTagsAndBranches(t *testing.T) {
+	srv, _ := gitServer(t)
+	ch := New(srv.URL)
+
+	tags, err := ch.Tags(ctx, "owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tags)
+	if !reflect.DeepEqual(tags, []string{"v0.1.0", "v0.2.0"}) {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+
+	branches, err := ch.Branches(ctx, "owner", "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(branches) != 1 {
+		t.Fatalf("unexpected branches %v", branches)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	srv, commits := gitServer(t)
+	d := gdp.New(New(srv.URL))
+
+	info, err := d.Info(ctx, "example.com/owner/repo", "v0.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &gdp.RevInfo{
+		Name:    commits[2],
+		Short:   "v0.2.0",
+		Version: "v0.2.0",
+		Time:    time.Date(2018, 3, 12, 10, 0, 0, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("unexpected rev info %#v", info)
+	}
+
+	// the first commit is not a ref tip, so resolving its
+	// short hash walks the history, deltas included.
+	pseudo := "v0.0.0-20180311214515-" + commits[0][:12]
+	info, err = d.Info(ctx, "example.com/owner/repo", pseudo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != commits[0] || info.Version != pseudo {
+		t.Fatalf("unexpected rev info %#v", info)
+	}
+
+	// queries resolve to the tag of the commit or its pseudo-version.
+	for query, version := range map[string]string{
+		commits[1][:7]: "v0.1.0",
+		commits[0]:     pseudo,
+	} {
+		info, err = d.Info(ctx, "example.com/owner/repo", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != version {
+			t.Fatalf("unexpected version %v for %v", info.Version, query)
+		}
+	}
+}
+
+func TestLatest(t *testing.T) {
+	srv, commits := gitServer(t)
+
+	info, err := gdp.New(New(srv.URL)).Latest(ctx, "example.com/owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the default branch is tagged.
+	if info.Name != commits[2] || info.Version != "v0.2.0" {
+		t.Fatalf("unexpected rev info %#v", info)
+	}
+
+	ac := New(srv.URL).(gdp.AncestorChecker)
+	if ok, err := ac.IsAncestor(ctx, "owner", "repo", "v0.1.0", commits[2]); err != nil || !ok {
+		t.Fatalf("expected v0.1.0 to be an ancestor: %v", err)
+	}
+	if ok, err := ac.IsAncestor(ctx, "owner", "repo", "v0.2.0", commits[0]); err != nil || ok {
+		t.Fatalf("expected v0.2.0 not to be an ancestor: %v", err)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	srv, commits := gitServer(t)
+	var infoRefs, histories int
+	counter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/info/refs") {
+			infoRefs++
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("command=fetch")) && !bytes.Contains(body, []byte("deepen")) {
+			histories++
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		httputil.NewSingleHostReverseProxy(mustParse(t, srv.URL)).ServeHTTP(w, r)
+	}))
+	defer counter.Close()
+
+	// the commit is checked against both tags.
+	info, err := gdp.New(New(counter.URL)).Info(ctx, "example.com/owner/repo", commits[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "v0.0.0-20180311214515-"+commits[0][:12] {
+		t.Fatalf("unexpected version %v", info.Version)
+	}
+	if infoRefs != 1 || histories != 1 {
+		t.Fatalf("expected capabilities and history to be fetched once, got %v and %v", infoRefs, histories)
+	}
+}
+
+func mustParse(t *testing.T, rawurl string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u
+}
+
+func TestGoMod(t *testing.T) {
+	srv, _ := gitServer(t)
+	var unfiltered int
+	counter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("deepen")) && !bytes.Contains(body, []byte("filter")) {
+			unfiltered++
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		httputil.NewSingleHostReverseProxy(mustParse(t, srv.URL)).ServeHTTP(w, r)
+	}))
+	defer counter.Close()
+	tmp, err := ioutil.TempDir("", "gitsmart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	bts, err := gdp.New(New(counter.URL)).GoMod(ctx, "example.com/owner/repo", "v0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bts) != "module example.com/owner/repo\n" {
+		t.Fatalf("unexpected mod file %s", bts)
+	}
+	if unfiltered != 0 {
+		t.Fatalf("expected the tree to be fetched without blobs, got %v full fetches", unfiltered)
+	}
+	if fis, _ := ioutil.ReadDir(tmp); len(fis) != 0 {
+		t.Fatalf("expected spooled blobs to be removed, got %v files", len(fis))
+	}
+}
+
+func TestZip(t *testing.T) {
+	srv, _ := gitServer(t)
+
+	rdr, err := gdp.New(New(srv.URL)).Zip(ctx, "example.com/owner/repo", "v0.2.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(bts), int64(len(bts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	expected := []string{
+		"example.com/owner/repo@v0.2.0/go.mod",
+		"example.com/owner/repo@v0.2.0/repo.go",
+		"example.com/owner/repo@v0.2.0/sub/sub.go",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected zip files %v", names)
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello, world")
+	// source size 12, target size 14, copy base[0:5], insert "!!", copy base[5:12]
+	delta := []byte{12, 14, 0x90, 5, 2, '!', '!', 0x91, 5, 7}
+	out, err := applyDelta(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "hello!!, world" {
+		t.Fatalf("unexpected delta result %q", out)
+	}
+}
+
+func TestSideband(t *testing.T) {
+	// an empty pkt-line and progress on band 2 are skipped.
+	resp := "0004" + "0009\x01PACK" + "0009\x02 50%" + "0007\x01v2" + flushPkt
+	bts, err := ioutil.ReadAll(&sideband{r: bufio.NewReader(strings.NewReader(resp))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bts) != "PACKv2" {
+		t.Fatalf("unexpected pack data %q", bts)
+	}
+
+	resp = "0004" + "000b\x03denied" + flushPkt
+	if _, err := ioutil.ReadAll(&sideband{r: bufio.NewReader(strings.NewReader(resp))}); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Fatalf("expected a remote error but got %v", err)
+	}
+}
@@ -0,0 +1,480 @@
+package gitsmart
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// object types as encoded in a packfile, see gitformat-pack(5).
+const (
+	objCommit   = 1
+	objTree     = 2
+	objBlob     = 3
+	objTag      = 4
+	objOfsDelta = 6
+	objRefDelta = 7
+)
+
+var typeNames = map[int]string{
+	objCommit: "commit",
+	objTree:   "tree",
+	objBlob:   "blob",
+	objTag:    "tag",
+}
+
+type object struct {
+	typ  int
+	data []byte // nil for a spooled blob
+	off  int64  // of a spooled blob in the spool file
+	size int64
+}
+
+// store holds the objects of a parsed packfile keyed by their hex
+// id. Blobs, which make up most of a tree, are spooled to a temporary
+// file instead of being kept in memory, so a store must be closed.
+type store struct {
+	objs  map[string]object
+	spool *os.File
+	end   int64
+}
+
+func newStore() *store {
+	return &store{objs: map[string]object{}}
+}
+
+// add stores an object of typ with data and returns it.
+func (s *store) add(typ int, data []byte) (object, error) {
+	o := object{typ: typ, data: data, size: int64(len(data))}
+	if typ == objBlob && len(data) > 0 {
+		if s.spool == nil {
+			f, err := ioutil.TempFile("", "gdp-gitsmart")
+			if err != nil {
+				return object{}, errors.Wrap(err, "spool")
+			}
+			s.spool = f
+		}
+		if _, err := s.spool.WriteAt(data, s.end); err != nil {
+			return object{}, errors.Wrap(err, "spool")
+		}
+		o.data, o.off = nil, s.end
+		s.end += o.size
+	}
+	s.objs[hashObject(typ, data)] = o
+
+	return o, nil
+}
+
+// open returns a reader of the contents of o.
+func (s *store) open(o object) io.Reader {
+	if o.data != nil || o.size == 0 {
+		return bytes.NewReader(o.data)
+	}
+
+	return io.NewSectionReader(s.spool, o.off, o.size)
+}
+
+// read returns the contents of o.
+func (s *store) read(o object) ([]byte, error) {
+	if o.data != nil || o.size == 0 {
+		return o.data, nil
+	}
+	data := make([]byte, o.size)
+	if _, err := s.spool.ReadAt(data, o.off); err != nil {
+		return nil, errors.Wrap(err, "spool")
+	}
+
+	return data, nil
+}
+
+// close removes the spooled blobs, if any.
+func (s *store) close() {
+	if s.spool != nil {
+		s.spool.Close()
+		os.Remove(s.spool.Name())
+		s.spool = nil
+	}
+}
+
+// rawObject is a packfile entry before deltas are resolved.
+type rawObject struct {
+	typ     int
+	data    []byte
+	baseOfs int64  // set for objOfsDelta
+	baseID  string // set for objRefDelta
+}
+
+// parsePack reads a version 2 packfile as it's streamed and
+// resolves every object in it, including deltified ones. Only
+// deltas are kept in memory until they are resolved.
+func parsePack(pack io.Reader) (st *store, err error) {
+	r := &packReader{r: bufio.NewReader(pack)}
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil || string(hdr[:4]) != "PACK" {
+		return nil, errors.New("invalid packfile signature")
+	}
+	if v := binary.BigEndian.Uint32(hdr[4:8]); v != 2 && v != 3 {
+		return nil, fmt.Errorf("unsupported packfile version %v", v)
+	}
+	n := binary.BigEndian.Uint32(hdr[8:12])
+
+	s := newStore()
+	defer func() {
+		if err != nil {
+			s.close()
+		}
+	}()
+	resolved := map[int64]object{}
+	deltas := map[int64]*rawObject{}
+	var offsets []int64
+	for i := uint32(0); i < n; i++ {
+		ofs := r.ofs
+		ro, err := readRawObject(r, ofs)
+		if err != nil {
+			return nil, errors.Wrapf(err, "object %v at offset %v", i, ofs)
+		}
+		if ro.typ == objOfsDelta || ro.typ == objRefDelta {
+			deltas[ofs] = ro
+			offsets = append(offsets, ofs)
+			continue
+		}
+		if resolved[ofs], err = s.add(ro.typ, ro.data); err != nil {
+			return nil, err
+		}
+	}
+
+	var resolve func(ofs int64, depth int) (object, error)
+	resolve = func(ofs int64, depth int) (object, error) {
+		if o, ok := resolved[ofs]; ok {
+			return o, nil
+		}
+		if depth > 10000 {
+			return object{}, errors.New("delta chain too deep")
+		}
+		ro, ok := deltas[ofs]
+		if !ok {
+			return object{}, fmt.Errorf("no object at offset %v", ofs)
+		}
+		var base object
+		if ro.typ == objOfsDelta {
+			var err error
+			if base, err = resolve(ro.baseOfs, depth+1); err != nil {
+				return object{}, err
+			}
+		} else if base, ok = s.objs[ro.baseID]; !ok {
+			return object{}, fmt.Errorf("missing delta base %v", ro.baseID)
+		}
+		bdata, err := s.read(base)
+		if err != nil {
+			return object{}, err
+		}
+		data, err := applyDelta(bdata, ro.data)
+		if err != nil {
+			return object{}, err
+		}
+		o, err := s.add(base.typ, data)
+		if err != nil {
+			return object{}, err
+		}
+		resolved[ofs] = o
+		delete(deltas, ofs)
+		return o, nil
+	}
+
+	// ref deltas may point at objects later in the pack,
+	// so keep resolving until no more progress is made.
+	pending := offsets
+	for len(pending) > 0 {
+		var next []int64
+		for _, ofs := range pending {
+			if _, err := resolve(ofs, 0); err != nil {
+				if ro, ok := deltas[ofs]; ok && ro.typ == objRefDelta {
+					next = append(next, ofs)
+					continue
+				}
+				return nil, err
+			}
+		}
+		if len(next) == len(pending) {
+			return nil, fmt.Errorf("unresolvable ref deltas: %v", len(next))
+		}
+		pending = next
+	}
+
+	return s, nil
+}
+
+func readRawObject(r *packReader, ofs int64) (*rawObject, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	ro := &rawObject{typ: int(c>>4) & 7}
+	// skip the rest of the inflated size, zlib knows where to stop.
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+	}
+
+	switch ro.typ {
+	case objOfsDelta:
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		rel := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return nil, err
+			}
+			rel = ((rel + 1) << 7) | int64(c&0x7f)
+		}
+		ro.baseOfs = ofs - rel
+	case objRefDelta:
+		var id [20]byte
+		if _, err := io.ReadFull(r, id[:]); err != nil {
+			return nil, err
+		}
+		ro.baseID = hex.EncodeToString(id[:])
+	case objCommit, objTree, objBlob, objTag:
+	default:
+		return nil, fmt.Errorf("unknown object type %v", ro.typ)
+	}
+
+	// packReader is an io.ByteReader, so zlib consumes
+	// exactly the compressed stream and nothing past it.
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "zlib")
+	}
+	ro.data, err = ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, errors.Wrap(err, "inflate")
+	}
+
+	return ro, nil
+}
+
+// packReader keeps track of the offset of a packfile being
+// read, which offset deltas refer to their base by.
+type packReader struct {
+	r   *bufio.Reader
+	ofs int64
+}
+
+func (p *packReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.ofs += int64(n)
+
+	return n, err
+}
+
+func (p *packReader) ReadByte() (byte, error) {
+	c, err := p.r.ReadByte()
+	if err == nil {
+		p.ofs++
+	}
+
+	return c, err
+}
+
+// applyDelta reconstructs an object from its base and a
+// delta made of copy and insert instructions.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	srcSize, err := binary.ReadUvarint(r)
+	if err != nil || srcSize != uint64(len(base)) {
+		return nil, errors.New("delta base size mismatch")
+	}
+	dstSize, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errors.New("invalid delta size")
+	}
+
+	out := make([]byte, 0, dstSize)
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		if op&0x80 == 0 {
+			if op == 0 {
+				return nil, errors.New("invalid delta opcode 0")
+			}
+			buf := make([]byte, op)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, errors.New("truncated delta insert")
+			}
+			out = append(out, buf...)
+			continue
+		}
+		var cpOfs, cpSize uint32
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, errors.New("truncated delta copy")
+			}
+			if i < 4 {
+				cpOfs |= uint32(b) << (8 * i)
+			} else {
+				cpSize |= uint32(b) << (8 * (i - 4))
+			}
+		}
+		if cpSize == 0 {
+			cpSize = 0x10000
+		}
+		if uint64(cpOfs)+uint64(cpSize) > uint64(len(base)) {
+			return nil, errors.New("delta copy out of bounds")
+		}
+		out = append(out, base[cpOfs:cpOfs+cpSize]...)
+	}
+	if uint64(len(out)) != dstSize {
+		return nil, errors.New("delta result size mismatch")
+	}
+
+	return out, nil
+}
+
+func hashObject(typ int, data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%v %v\x00", typeNames[typ], len(data))
+	h.Write(data)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type commit struct {
+	tree    string
+	parents []string
+	time    time.Time
+}
+
+func parseCommit(data []byte) (*commit, error) {
+	var c commit
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			break
+		}
+		key, val := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			key, val = line[:i], line[i+1:]
+		}
+		switch key {
+		case "tree":
+			c.tree = val
+		case "parent":
+			c.parents = append(c.parents, val)
+		case "committer":
+			// Name <email> 1538000000 +0200
+			fields := strings.Fields(val[strings.LastIndexByte(val, '>')+1:])
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid committer line %q", line)
+			}
+			sec, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid committer time %q", line)
+			}
+			c.time = time.Unix(sec, 0).UTC()
+		}
+	}
+	if c.tree == "" {
+		return nil, errors.New("commit without a tree")
+	}
+
+	return &c, nil
+}
+
+type treeEntry struct {
+	mode string
+	name string
+	id   string
+}
+
+func parseTree(data []byte) ([]treeEntry, error) {
+	var entries []treeEntry
+	for len(data) > 0 {
+		sp := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if sp < 0 || nul < sp || len(data) < nul+21 {
+			return nil, errors.New("malformed tree")
+		}
+		entries = append(entries, treeEntry{
+			mode: string(data[:sp]),
+			name: string(data[sp+1 : nul]),
+			id:   hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+		data = data[nul+21:]
+	}
+
+	return entries, nil
+}
+
+func (s *store) commit(id string) (*commit, error) {
+	o, ok := s.objs[id]
+	if !ok || o.typ != objCommit {
+		return nil, fmt.Errorf("commit %v not found in pack", id)
+	}
+
+	return parseCommit(o.data)
+}
+
+func (s *store) tree(id string) ([]treeEntry, error) {
+	o, ok := s.objs[id]
+	if !ok || o.typ != objTree {
+		return nil, fmt.Errorf("tree %v not found in pack", id)
+	}
+
+	return parseTree(o.data)
+}
+
+// lookup returns the id of the blob at path, a slash
+// separated path relative to the root tree.
+func (s *store) lookup(root, path string) (string, bool, error) {
+	id := root
+	els := strings.Split(path, "/")
+	for i, el := range els {
+		entries, err := s.tree(id)
+		if err != nil {
+			return "", false, err
+		}
+		found := false
+		for _, e := range entries {
+			if e.name != el {
+				continue
+			}
+			if (i < len(els)-1) != (e.mode == "40000") {
+				return "", false, nil
+			}
+			id, found = e.id, true
+			break
+		}
+		if !found {
+			return "", false, nil
+		}
+	}
+
+	return id, true, nil
+}
+
+// blob returns the contents of the blob id.
+func (s *store) blob(id string) ([]byte, error) {
+	o, ok := s.objs[id]
+	if !ok || o.typ != objBlob {
+		return nil, fmt.Errorf("blob %v not found in pack", id)
+	}
+
+	return s.read(o)
+}
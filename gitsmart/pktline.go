@@ -0,0 +1,123 @@
+package gitsmart
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// pkt-line special packets, see gitprotocol-common(5).
+const (
+	flushPkt = "0000"
+	delimPkt = "0001"
+)
+
+// errFlush and errDelim are returned by readPkt when
+// it encounters the matching special packet.
+var (
+	errFlush = errors.New("flush-pkt")
+	errDelim = errors.New("delim-pkt")
+)
+
+// pktWriter builds a pkt-line encoded request body.
+type pktWriter struct {
+	bytes.Buffer
+}
+
+func (w *pktWriter) line(format string, args ...interface{}) {
+	s := fmt.Sprintf(format, args...) + "\n"
+	fmt.Fprintf(&w.Buffer, "%04x%s", len(s)+4, s)
+}
+
+func (w *pktWriter) flush() { w.WriteString(flushPkt) }
+
+func (w *pktWriter) delim() { w.WriteString(delimPkt) }
+
+// readPkt reads a single pkt-line. It returns errFlush or
+// errDelim for the special packets and the raw payload
+// otherwise, including any trailing newline.
+func readPkt(r *bufio.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(string(hdr[:]), 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pkt-line length %q", hdr[:])
+	}
+	switch n {
+	case 0:
+		return nil, errFlush
+	case 1:
+		return nil, errDelim
+	case 2, 3:
+		return nil, fmt.Errorf("unexpected pkt-line length %v", n)
+	}
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// readLines reads text pkt-lines, without their trailing
+// newline, until the next flush or delim packet.
+func readLines(r *bufio.Reader) ([]string, error) {
+	var lines []string
+	for {
+		pkt, err := readPkt(r)
+		if err == errFlush || err == errDelim {
+			return lines, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(pkt, []byte("ERR ")) {
+			return nil, fmt.Errorf("remote error: %s", bytes.TrimSpace(pkt[4:]))
+		}
+		lines = append(lines, string(bytes.TrimSuffix(pkt, []byte("\n"))))
+	}
+}
+
+// sideband reads the pack data of band 1 out of the packfile
+// section of a fetch response, up to its closing flush-pkt,
+// so that the pack can be parsed as it arrives.
+type sideband struct {
+	r   *bufio.Reader
+	buf []byte
+	err error
+}
+
+func (s *sideband) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		pkt, err := readPkt(s.r)
+		if err == errFlush {
+			s.err = io.EOF
+			continue
+		} else if err != nil {
+			s.err = err
+			continue
+		}
+		// an empty pkt-line carries no band at all.
+		if len(pkt) == 0 {
+			continue
+		}
+		switch pkt[0] {
+		case 1:
+			s.buf = pkt[1:]
+		case 3:
+			s.err = fmt.Errorf("remote error: %s", bytes.TrimSpace(pkt[1:]))
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+
+	return n, nil
+}
@@ -37,16 +37,24 @@ func (ch *downloadProtocol) parsePath(module string) (string, string) {
 }
 
 func (ch *downloadProtocol) List(ctx context.Context, module string) ([]string, error) {
-	path, major, err := ch.githubPath(module)
+	_, major, err := ch.githubPath(module)
 	if err != nil {
 		return nil, errors.Wrap(err, "gopkgin.List")
 	}
 
-	tags, err := ch.gdp.List(ctx, path)
+	// gdp.List would mark v2+ tags of the github path +incompatible,
+	// but the major version lives in the gopkg.in path instead.
+	owner, repo := ch.parsePath(module)
+	repoTags, err := ch.gch.Tags(ctx, owner, repo)
 	if err != nil {
 		return nil, errors.Wrap(err, "gopkgin.List")
 	}
-	owner, repo := ch.parsePath(module)
+	tags := []string{}
+	for _, t := range repoTags {
+		if semver.IsValid(t) && semver.Canonical(t) == t {
+			tags = append(tags, t)
+		}
+	}
 	branches, err := ch.gch.Branches(ctx, owner, repo)
 	if err != nil {
 		return nil, errors.Wrap(err, "gopkgin.Branches")
@@ -71,6 +79,11 @@ func (ch *downloadProtocol) Info(ctx context.Context, module string, version str
 	if err != nil {
 		return nil, errors.Wrap(err, "gopkgin.Info")
 	}
+	// tags go straight to github for the same reason as in List.
+	if semver.IsValid(version) && !gdp.IsPseudo(version) {
+		owner, repo := ch.parsePath(module)
+		return ch.gch.TagInfo(ctx, owner, repo, version)
+	}
 
 	return ch.gdp.Info(ctx, path, version)
 }
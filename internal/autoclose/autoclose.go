@@ -0,0 +1,46 @@
+// Package autoclose releases what a reader holds, such as a
+// response body or a temporary file, once it's read to the end,
+// for the zips that are handed to callers who may never close them.
+package autoclose
+
+import "io"
+
+// Reader reads r and calls close once r is read to the end or
+// fails, or when closed by a caller that stops reading early.
+type Reader struct {
+	r      io.Reader
+	close  func() error
+	closed bool
+}
+
+// New returns a Reader of r that calls close at most once.
+func New(r io.Reader, close func() error) *Reader {
+	return &Reader{r: r, close: close}
+}
+
+func (a *Reader) Read(p []byte) (int, error) {
+	if a.closed {
+		return 0, io.EOF
+	}
+	n, err := a.r.Read(p)
+	if err != nil {
+		a.Close()
+	}
+
+	return n, err
+}
+
+// Close calls close unless it already was.
+func (a *Reader) Close() error {
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+
+	return a.close()
+}
+
+// Closed reports whether close was called.
+func (a *Reader) Closed() bool {
+	return a.closed
+}
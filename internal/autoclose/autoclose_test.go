@@ -0,0 +1,32 @@
+package autoclose
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReader(t *testing.T) {
+	var calls int
+	close := func() error {
+		calls++
+		return nil
+	}
+
+	r := New(strings.NewReader("zip"), close)
+	if bts, err := ioutil.ReadAll(r); err != nil || string(bts) != "zip" {
+		t.Fatalf("unexpected read %q: %v", bts, err)
+	}
+	r.Close()
+	if !r.Closed() || calls != 1 {
+		t.Fatalf("expected a single close once read to the end but got %v", calls)
+	}
+
+	// a caller that stops early closes it.
+	r = New(strings.NewReader("zip"), close)
+	r.Read(make([]byte, 1))
+	r.Close()
+	if n, _ := r.Read(make([]byte, 1)); n != 0 || calls != 2 {
+		t.Fatalf("expected nothing to be read after close, read %v with %v closes", n, calls)
+	}
+}
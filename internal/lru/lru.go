@@ -0,0 +1,73 @@
+// Package lru is a bounded in-memory cache that
+// evicts the least recently used entry when full.
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache holds up to a fixed number of byte slices by key.
+// It is safe for concurrent use.
+type Cache struct {
+	mu    sync.Mutex
+	limit int
+	ll    *list.List // front is the most recently used
+	items map[string]*list.Element
+}
+
+type entry struct {
+	key string
+	val []byte
+}
+
+// New returns a Cache that holds up to limit entries.
+func New(limit int) *Cache {
+	return &Cache{
+		limit: limit,
+		ll:    list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// Get returns the value of key and marks it as recently used.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+
+	return el.Value.(*entry).val, true
+}
+
+// Add sets the value of key, evicting the least
+// recently used entry if the cache is full.
+func (c *Cache) Add(key string, val []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		el.Value.(*entry).val = val
+		c.ll.MoveToFront(el)
+		return
+	}
+	if c.limit <= 0 {
+		return
+	}
+	for c.ll.Len() >= c.limit {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry).key)
+	}
+	c.items[key] = c.ll.PushFront(&entry{key, val})
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ll.Len()
+}
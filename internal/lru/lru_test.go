@@ -0,0 +1,25 @@
+package lru
+
+import "testing"
+
+func TestCache(t *testing.T) {
+	c := New(2)
+	c.Add("a", []byte("1"))
+	c.Add("b", []byte("2"))
+	// a is used, so b is the one evicted by c.
+	if v, ok := c.Get("a"); !ok || string(v) != "1" {
+		t.Fatalf("unexpected value %q of a", v)
+	}
+	c.Add("c", []byte("3"))
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("expected b to be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("expected %v to be cached", k)
+		}
+	}
+	if c.Len() != 2 {
+		t.Fatalf("unexpected length %v", c.Len())
+	}
+}
@@ -0,0 +1,129 @@
+// Package testhost holds the fixture shared by the tests of the code
+// hosts that fake their vendor API: a single repository with v0.1.0,
+// which has no go.mod file, and v0.2.0 tagged at SHA, which has a
+// go.mod file and a package file. Each host's fake API serves that
+// repository in its own URL shapes and Run checks what gdp makes of it.
+package testhost
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+)
+
+// SHA is the commit v0.2.0 is tagged at.
+const SHA = "645ef00459ed84a119197bfb8d8205042c6df63d"
+
+// Time is the commit time of SHA.
+var Time = time.Date(2016, 9, 29, 1, 48, 1, 0, time.UTC)
+
+// Files returns the files of module at v0.2.0.
+func Files(module string) map[string]string {
+	return map[string]string{
+		"go.mod":  "module " + module + "\n",
+		"repo.go": "package repo\n",
+	}
+}
+
+// Tarball returns a tar.gz archive of files under dir,
+// which ends with a slash, like the archives of code hosts.
+func Tarball(t *testing.T, dir string, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: dir, Typeflag: tar.TypeDir, Mode: 0755})
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: dir + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+
+	return buf.Bytes()
+}
+
+// Run checks List, Info, GoMod and Zip of dp, the download
+// protocol of a code host whose fake API serves module.
+func Run(t *testing.T, dp gdp.DownloadProtocol, module string) {
+	ctx := context.Background()
+
+	t.Run("List", func(t *testing.T) {
+		tags, err := dp.List(ctx, module)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tags, []string{"v0.2.0", "v0.1.0"}) {
+			t.Fatalf("unexpected list versions %v", tags)
+		}
+	})
+
+	t.Run("Info", func(t *testing.T) {
+		info, err := dp.Info(ctx, module, "v0.2.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := &gdp.RevInfo{Name: SHA, Short: "v0.2.0", Version: "v0.2.0", Time: Time}
+		if !reflect.DeepEqual(info, expected) {
+			t.Fatalf("unexpected rev info %#v", info)
+		}
+
+		pseudo := "v0.0.0-20160929014801-" + SHA[:12]
+		info, err = dp.Info(ctx, module, pseudo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != pseudo || info.Name != SHA {
+			t.Fatalf("unexpected rev info %#v", info)
+		}
+	})
+
+	t.Run("GoMod", func(t *testing.T) {
+		// v0.1.0 has no go.mod file, so one is synthesized.
+		for _, version := range []string{"v0.2.0", "v0.1.0"} {
+			bts, err := dp.GoMod(ctx, module, version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(bts) != "module "+module+"\n" {
+				t.Fatalf("unexpected mod file %s of %v", bts, version)
+			}
+		}
+	})
+
+	t.Run("Zip", func(t *testing.T) {
+		rdr, err := dp.Zip(ctx, module, "v0.2.0", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer gdp.CloseReader(rdr)
+		bts, err := ioutil.ReadAll(rdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(bts), int64(len(bts)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		prefix := module + "@v0.2.0/"
+		if !reflect.DeepEqual(names, []string{prefix + "go.mod", prefix + "repo.go"}) {
+			t.Fatalf("unexpected zip files %v", names)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+package local
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+)
+
+// New returns a CodeHost that serves git repositories
+// already on disk, such as mirrors in an air-gapped network.
+// owner/repo is looked up as root/owner/repo.git and then as
+// root/owner/repo, so both bare and regular clones work.
+// It shells out to the git binary and never touches the network.
+// Use gdp.New to create a download protocol out of it.
+func New(root string) gdp.CodeHost {
+	return &codeHost{root}
+}
+
+type codeHost struct {
+	root string
+}
+
+func (d *codeHost) Tags(ctx context.Context, owner, repo string) ([]string, error) {
+	tags, err := d.refs(ctx, owner, repo, "refs/tags")
+	return tags, errors.Wrap(err, "local.Tags")
+}
+
+func (d *codeHost) Branches(ctx context.Context, owner, repo string) ([]string, error) {
+	branches, err := d.refs(ctx, owner, repo, "refs/heads")
+	return branches, errors.Wrap(err, "local.Branches")
+}
+
+func (d *codeHost) CommitInfo(ctx context.Context, owner, repo, sha string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	name, t, err := d.commit(ctx, owner, repo, sha)
+	if err != nil {
+		return nil, errors.Wrapf(err, "local.CommitInfo failed for %v/%v@%v", owner, repo, sha)
+	}
+
+	ri.Name = name
+	ri.Short = ri.Name[:12]
+	ri.Time = t
+	ri.Version = gdp.Pseudo(ri.Time, ri.Short)
+
+	return &ri, nil
+}
+
+func (d *codeHost) TagInfo(ctx context.Context, owner, repo, tag string) (*gdp.RevInfo, error) {
+	var ri gdp.RevInfo
+	name, t, err := d.commit(ctx, owner, repo, "refs/tags/"+tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "local.TagInfo failed for %v/%v@%v", owner, repo, tag)
+	}
+
+	ri.Name = name
+	ri.Short = tag
+	ri.Version = tag
+	ri.Time = t
+
+	return &ri, nil
+}
+
+func (d *codeHost) LatestCommit(ctx context.Context, owner, repo string) (sha string, t time.Time, err error) {
+	sha, t, err = d.commit(ctx, owner, repo, "HEAD")
+	return sha, t, errors.Wrap(err, "local.LatestCommit")
+}
+
+func (d *codeHost) IsAncestor(ctx context.Context, owner, repo, ancestor, rev string) (bool, error) {
+	dir, err := d.dir(owner, repo)
+	if err != nil {
+		return false, err
+	}
+	a, _, err := d.commit(ctx, owner, repo, ancestor)
+	if err != nil {
+		return false, errors.Wrap(err, "local.IsAncestor")
+	}
+	r, _, err := d.commit(ctx, owner, repo, rev)
+	if err != nil {
+		return false, errors.Wrap(err, "local.IsAncestor")
+	}
+	// merge-base --is-ancestor exits with 1 when it isn't one.
+	cmd := exec.CommandContext(ctx, "git", "merge-base", "--is-ancestor", a, r)
+	cmd.Dir = dir
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "local.IsAncestor")
+	}
+
+	return true, nil
+}
+
+func (d *codeHost) GetModFile(ctx context.Context, owner, repo, dir, version string) ([]byte, error) {
+	gitDir, err := d.dir(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	sha, _, err := d.commit(ctx, owner, repo, version)
+	if err != nil {
+		return nil, errors.Wrap(err, "local.GetModFile")
+	}
+	obj := sha + ":" + path.Join(dir, "go.mod")
+	if _, err := git(ctx, gitDir, "cat-file", "-e", obj); err != nil {
+		return nil, gdp.ErrNotFound
+	}
+	bts, err := git(ctx, gitDir, "cat-file", "blob", obj)
+	if err != nil {
+		return nil, errors.Wrap(err, "local.GetModFile")
+	}
+
+	return bts, nil
+}
+
+// TarURL is not supported because there is nothing to download,
+// archives are produced by Archive instead.
+func (d *codeHost) TarURL(ctx context.Context, owner, repo, version string) (string, error) {
+	return "", errors.New("local: no tarball url, use Archive")
+}
+
+// Archive streams the output of git archive.
+func (d *codeHost) Archive(ctx context.Context, owner, repo, ref string) (io.ReadCloser, gdp.ArchiveFormat, error) {
+	dir, err := d.dir(owner, repo)
+	if err != nil {
+		return nil, 0, err
+	}
+	sha, _, err := d.commit(ctx, owner, repo, ref)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "local.Archive")
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", "archive", "--format=tar.gz", "--prefix="+repo+"/", sha)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "local.Archive")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, 0, errors.Wrap(err, "local.Archive")
+	}
+
+	return &archive{out, cmd, &stderr}, gdp.ArchiveTarGz, nil
+}
+
+type archive struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (a *archive) Close() error {
+	a.ReadCloser.Close()
+	if err := a.cmd.Wait(); err != nil {
+		return fmt.Errorf("git archive: %v: %s", err, bytes.TrimSpace(a.stderr.Bytes()))
+	}
+
+	return nil
+}
+
+// dir returns the repository of owner/repo under root. Both are
+// single path elements, so that they can't point outside of it.
+func (d *codeHost) dir(owner, repo string) (string, error) {
+	for _, el := range []string{owner, repo} {
+		if el == "." || el == ".." || strings.ContainsAny(el, `/\`) {
+			return "", errors.Wrapf(gdp.ErrNotFound, "invalid path element %q", el)
+		}
+	}
+	if repo == "" {
+		return "", errors.Wrap(gdp.ErrNotFound, "empty repository name")
+	}
+	base := filepath.Join(d.root, owner, repo)
+	for _, dir := range []string{base + ".git", base} {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir, nil
+		}
+	}
+
+	return "", gdp.ErrNotFound
+}
+
+func (d *codeHost) refs(ctx context.Context, owner, repo, prefix string) ([]string, error) {
+	dir, err := d.dir(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	out, err := git(ctx, dir, "for-each-ref", "--format=%(refname)", prefix)
+	if err != nil {
+		return nil, err
+	}
+	refs := []string{}
+	for _, r := range strings.Fields(string(out)) {
+		refs = append(refs, strings.TrimPrefix(r, prefix+"/"))
+	}
+
+	return refs, nil
+}
+
+// commit resolves rev to a commit and returns its full hash
+// and committer time. Other commands are only ever given the
+// resolved hash so that a version can't be mistaken for a flag.
+func (d *codeHost) commit(ctx context.Context, owner, repo, rev string) (string, time.Time, error) {
+	dir, err := d.dir(owner, repo)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	out, err := git(ctx, dir, "rev-parse", "--verify", "--quiet", "--end-of-options", rev+"^{commit}")
+	if err != nil {
+		return "", time.Time{}, gdp.ErrNotFound
+	}
+	sha := strings.TrimSpace(string(out))
+	out, err = git(ctx, dir, "show", "-s", "--format=%ct", sha)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "parse commit time")
+	}
+
+	return sha, time.Unix(sec, 0).UTC(), nil
+}
+
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %v: %v: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return out, nil
+}
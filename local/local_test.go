@@ -0,0 +1,227 @@
+package local
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+)
+
+var ctx = context.Background()
+
+var gitEnv = append(
+	os.Environ(),
+	"GIT_CONFIG_NOSYSTEM=1",
+	"HOME="+os.TempDir(),
+	"GIT_AUTHOR_NAME=gdp",
+	"GIT_AUTHOR_EMAIL=gdp@example.com",
+	"GIT_COMMITTER_NAME=gdp",
+	"GIT_COMMITTER_EMAIL=gdp@example.com",
+)
+
+// mirror creates root/owner/repo.git with two commits,
+// the first one tagged v0.1.0, and returns root.
+func mirror(t *testing.T) (root string, commits []string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	work := filepath.Join(root, "work")
+
+	run(t, "", nil, "init", "-q", work)
+	write(t, work, "go.mod", "module git.mycorp.com/owner/repo\n")
+	write(t, work, "repo.go", "package repo\n")
+	commits = append(commits, commitAll(t, work, "2018-03-11T21:45:15Z"))
+	run(t, work, nil, "tag", "v0.1.0")
+
+	os.Remove(filepath.Join(work, "go.mod"))
+	write(t, work, "sub/sub.go", "package sub\n")
+	commits = append(commits, commitAll(t, work, "2018-03-12T10:00:00Z"))
+	run(t, "", nil, "clone", "-q", "--bare", work, filepath.Join(root, "owner", "repo.git"))
+
+	return root, commits
+}
+
+func run(t *testing.T, dir string, env []string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(append([]string{}, gitEnv...), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func write(t *testing.T, dir, name, content string) {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	os.MkdirAll(filepath.Dir(p), 0755)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func commitAll(t *testing.T, work, date string) string {
+	t.Helper()
+	run(t, work, nil, "add", "-A")
+	run(t, work, []string{"GIT_AUTHOR_DATE=" + date, "GIT_COMMITTER_DATE=" + date}, "commit", "-q", "-m", date)
+
+	return run(t, work, nil, "rev-parse", "HEAD")
+}
+
+func TestOutsideRoot(t *testing.T) {
+	root, _ := mirror(t)
+
+	// owner/repo.git is right outside of root/owner/sub.
+	ch := New(filepath.Join(root, "owner", "sub"))
+	for _, tc := range [][2]string{{"..", "repo"}, {"", "../repo"}, {".", ".."}} {
+		if _, err := ch.Tags(ctx, tc[0], tc[1]); !errors.Is(err, gdp.ErrNotFound) {
+			t.Fatalf("expected ErrNotFound for %v/%v but got %v", tc[0], tc[1], err)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	root, _ := mirror(t)
+
+	tags, err := gdp.New(New(root)).List(ctx, "git.mycorp.com/owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"v0.1.0"}) {
+		t.Fatalf("unexpected list versions %v", tags)
+	}
+}
+
+func TestInfo(t *testing.T) {
+	root, commits := mirror(t)
+	d := gdp.New(New(root))
+
+	info, err := d.Info(ctx, "git.mycorp.com/owner/repo", "v0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &gdp.RevInfo{
+		Name:    commits[0],
+		Short:   "v0.1.0",
+		Version: "v0.1.0",
+		Time:    time.Date(2018, 3, 11, 21, 45, 15, 0, time.UTC),
+	}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("unexpected rev info %#v", info)
+	}
+
+	// the default branch is one commit ahead of v0.1.0.
+	branches, err := New(root).Branches(ctx, "owner", "repo")
+	if err != nil || len(branches) != 1 {
+		t.Fatalf("unexpected branches %v: %v", branches, err)
+	}
+	for query, version := range map[string]string{
+		branches[0]:    "v0.1.1-0.20180312100000-" + commits[1][:12],
+		commits[1][:7]: "v0.1.1-0.20180312100000-" + commits[1][:12],
+		commits[0]:     "v0.1.0",
+	} {
+		info, err = d.Info(ctx, "git.mycorp.com/owner/repo", query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Version != version {
+			t.Fatalf("unexpected version %v for %v", info.Version, query)
+		}
+	}
+	if _, err = d.Info(ctx, "git.mycorp.com/owner/repo", "nobranch"); err != gdp.ErrNotFound {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+
+	_, err = d.Info(ctx, "git.mycorp.com/owner/missing", "v0.1.0")
+	if err == nil {
+		t.Fatal("expected an error for a missing repository")
+	}
+}
+
+func TestLatest(t *testing.T) {
+	root, commits := mirror(t)
+
+	info, err := gdp.New(New(root)).Latest(ctx, "git.mycorp.com/owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != commits[1] || info.Version != "v0.1.1-0.20180312100000-"+commits[1][:12] {
+		t.Fatalf("unexpected rev info %#v", info)
+	}
+
+	ac := New(root).(gdp.AncestorChecker)
+	if ok, err := ac.IsAncestor(ctx, "owner", "repo", "v0.1.0", commits[1]); err != nil || !ok {
+		t.Fatalf("expected v0.1.0 to be an ancestor: %v", err)
+	}
+	if ok, err := ac.IsAncestor(ctx, "owner", "repo", commits[1], "v0.1.0"); err != nil || ok {
+		t.Fatalf("expected %v not to be an ancestor: %v", commits[1], err)
+	}
+}
+
+func TestGoMod(t *testing.T) {
+	root, commits := mirror(t)
+	d := gdp.New(New(root))
+
+	bts, err := d.GoMod(ctx, "git.mycorp.com/owner/repo", "v0.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bts) != "module git.mycorp.com/owner/repo\n" {
+		t.Fatalf("unexpected mod file %s", bts)
+	}
+
+	// go.mod was removed in the second commit.
+	_, err = New(root).GetModFile(ctx, "owner", "repo", "", commits[1])
+	if err != gdp.ErrNotFound {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+}
+
+func TestZip(t *testing.T) {
+	root, commits := mirror(t)
+	version := "v0.0.0-20180312100000-" + commits[1][:12]
+
+	rdr, err := gdp.New(New(root)).Zip(ctx, "git.mycorp.com/owner/repo", version, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(bts), int64(len(bts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	prefix := "git.mycorp.com/owner/repo@" + version + "/"
+	expected := []string{prefix + "repo.go", prefix + "sub/sub.go"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected zip files %v", names)
+	}
+}
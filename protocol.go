@@ -1,18 +1,18 @@
 package gdp
 
 import (
-	"archive/tar"
-	"archive/zip"
-	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
 	"net/http"
-	"path/filepath"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/marwan-at-work/vgop/semver"
 	"github.com/pkg/errors"
+	gomodule "golang.org/x/mod/module"
+	modzip "golang.org/x/mod/zip"
 )
 
 type generic struct {
@@ -27,52 +27,126 @@ func New(ch CodeHost) DownloadProtocol {
 }
 
 func (g *generic) List(ctx context.Context, module string) ([]string, error) {
-	tags := []string{}
-	owner, repo, err := SplitPath(module)
+	m, err := g.parseModule(module)
 	if err != nil {
-		return nil, errors.Wrap(err, "generic.splitPath")
+		return nil, errors.Wrap(err, "generic.parseModule")
+	}
+	tags, err := g.tags(ctx, m)
+	if err != nil || m.major != "" {
+		return tags, err
+	}
+
+	// v2+ tags only belong to a path without a major version suffix
+	// as +incompatible versions, which have no go.mod. Tags that do
+	// have one opted into modules and are served from their /vN path.
+	list := []string{}
+	for _, t := range tags {
+		if !needsIncompatible(t) {
+			list = append(list, t)
+			continue
+		}
+		_, mod, err := g.modFile(ctx, m, tagPrefix(m.dir)+t)
+		if err != nil {
+			return nil, errors.Wrap(err, "generic.modFile")
+		}
+		if mod == nil {
+			list = append(list, t+"+incompatible")
+		}
 	}
 
-	repoTags, err := g.ch.Tags(ctx, owner, repo)
+	return list, nil
+}
+
+// needsIncompatible reports whether version is v2 or above, and
+// so needs +incompatible on a path without a major version suffix.
+func needsIncompatible(version string) bool {
+	major := semver.Major(version)
+	return major != "v0" && major != "v1"
+}
+
+// tags returns the versions of the module m has been tagged with.
+func (g *generic) tags(ctx context.Context, m *modulePath) ([]string, error) {
+	tags := []string{}
+	repoTags, err := g.ch.Tags(ctx, m.owner, m.repo)
 	if err != nil {
 		return nil, errors.Wrap(err, "generic.Tags")
 	}
 
+	prefix := tagPrefix(m.dir)
 	for _, t := range repoTags {
-		if semver.IsValid(t) && semver.Canonical(t) == t {
-			tags = append(tags, t)
+		if !strings.HasPrefix(t, prefix) {
+			continue
+		}
+		t = strings.TrimPrefix(t, prefix)
+		if !semver.IsValid(t) || semver.Canonical(t) != t {
+			continue
+		}
+		if m.major != "" && "/"+semver.Major(t) != m.major {
+			continue
 		}
+		tags = append(tags, t)
 	}
 
 	return tags, nil
-
 }
 
 func (g *generic) Info(ctx context.Context, module string, version string) (*RevInfo, error) {
-	version = strings.Replace(version, "+incompatible", "", 1)
-	owner, repo, err := SplitPath(module)
+	m, err := g.parseModule(module)
 	if err != nil {
-		return nil, errors.Wrap(err, "info.SplitPath")
+		return nil, errors.Wrap(err, "info.parseModule")
 	}
 	if IsPseudo(version) {
 		sha, err := ShaFromPseudo(version)
 		if err != nil {
 			return nil, errors.Wrap(err, "info.shaFromPseudo")
 		}
-		return g.ch.CommitInfo(ctx, owner, repo, sha)
+		ri, err := g.ch.CommitInfo(ctx, m.owner, m.repo, sha)
+		if err != nil {
+			return nil, err
+		}
+		// any valid pseudo-version names the commit, not
+		// just the one commitVersion would have picked.
+		ri.Version = version
+		return ri, nil
+	}
+
+	if !semver.IsValid(version) {
+		return g.query(ctx, m, version)
+	}
+	tag := strings.TrimSuffix(version, "+incompatible")
+	if m.major != "" && "/"+semver.Major(tag) != m.major {
+		return nil, errors.Wrapf(ErrInvalidVersion, "info: version %v does not match module path %v", version, module)
+	}
+
+	ri, err := g.ch.TagInfo(ctx, m.owner, m.repo, tagPrefix(m.dir)+tag)
+	if err != nil {
+		return nil, err
+	}
+	if m.major == "" && needsIncompatible(tag) {
+		_, mod, err := g.modFile(ctx, m, tagPrefix(m.dir)+tag)
+		if err != nil {
+			return nil, errors.Wrap(err, "info.modFile")
+		}
+		if mod != nil {
+			return nil, errors.Wrapf(ErrInvalidVersion, "info: %v has a go.mod file and is not a version of %v", tag, module)
+		}
+		tag += "+incompatible"
 	}
+	// the tag of a module in a subdirectory is dir/version.
+	ri.Short = tag
+	ri.Version = tag
 
-	return g.ch.TagInfo(ctx, owner, repo, version)
+	return ri, nil
 }
 
 func (g *generic) Latest(ctx context.Context, module string) (*RevInfo, error) {
 	var ri RevInfo
-	owner, repo, err := SplitPath(module)
+	m, err := g.parseModule(module)
 	if err != nil {
-		return nil, errors.Wrap(err, "latest.splitPath")
+		return nil, errors.Wrap(err, "latest.parseModule")
 	}
 
-	sha, t, err := g.ch.LatestCommit(ctx, owner, repo)
+	sha, t, err := g.ch.LatestCommit(ctx, m.owner, m.repo)
 	if err != nil {
 		return nil, errors.Wrap(err, "latest.LatestCommit")
 	}
@@ -80,133 +154,303 @@ func (g *generic) Latest(ctx context.Context, module string) (*RevInfo, error) {
 	ri.Name = sha
 	ri.Short = ri.Name[:12]
 	ri.Time = t
-	ri.Version = Pseudo(ri.Time, ri.Short)
+	if err := g.commitVersion(ctx, m, &ri); err != nil {
+		return nil, errors.Wrap(err, "latest.commitVersion")
+	}
 
 	return &ri, nil
 }
 
-func (g *generic) GoMod(ctx context.Context, module string, version string) ([]byte, error) {
-	version = strings.Replace(version, "+incompatible", "", 1)
-	var err error
-	owner, repo, err := SplitPath(module)
+// query resolves a version that isn't semver, such as
+// go get mod@main or mod@abc1234, to a branch or commit.
+func (g *generic) query(ctx context.Context, m *modulePath, query string) (*RevInfo, error) {
+	branches, err := g.ch.Branches(ctx, m.owner, m.repo)
+	// without a list of branches, the code host
+	// is left to resolve the query as a commit.
+	unlisted := errors.Is(err, ErrUnsupported)
+	if err != nil && !unlisted {
+		return nil, errors.Wrap(err, "query.Branches")
+	}
+	isBranch := unlisted
+	for _, b := range branches {
+		if b == query {
+			isBranch = true
+			break
+		}
+	}
+	if !isBranch && !isHash(query) {
+		return nil, ErrNotFound
+	}
+
+	ri, err := g.ch.CommitInfo(ctx, m.owner, m.repo, query)
 	if err != nil {
-		return nil, errors.Wrap(err, "goMod.splitPath")
+		return nil, errors.Wrap(err, "query.CommitInfo")
 	}
-	if IsPseudo(version) {
-		version, err = ShaFromPseudo(version)
+	if err := g.commitVersion(ctx, m, ri); err != nil {
+		return nil, errors.Wrap(err, "query.commitVersion")
+	}
+
+	return ri, nil
+}
+
+// isHash reports whether s looks like a full or abbreviated commit hash.
+func isHash(s string) bool {
+	if len(s) < 7 || len(s) > 40 {
+		return false
+	}
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// commitVersion sets the version of the commit ri to the tag of m
+// pointing at it, if any, or else to its pseudo-version relative
+// to the latest tag of m that is one of its ancestors.
+func (g *generic) commitVersion(ctx context.Context, m *modulePath, ri *RevInfo) error {
+	major := "v0"
+	if m.major != "" {
+		major = m.major[1:]
+	}
+	ac, ok := g.ch.(AncestorChecker)
+	if !ok {
+		ri.Version = PseudoVersion(major, "", ri.Time, ri.Short)
+		return nil
+	}
+
+	tags, err := g.tags(ctx, m)
+	if err != nil {
+		return err
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return semver.Compare(tags[i], tags[j]) > 0
+	})
+	for _, t := range tags {
+		ok, err := ac.IsAncestor(ctx, m.owner, m.repo, tagPrefix(m.dir)+t, ri.Name)
+		if err != nil {
+			return errors.Wrap(err, "IsAncestor")
+		}
+		if !ok {
+			continue
+		}
+		// without a major version suffix, v2+ tags only count
+		// as +incompatible versions, which have no go.mod.
+		version := t
+		if m.major == "" && needsIncompatible(t) {
+			_, mod, err := g.modFile(ctx, m, tagPrefix(m.dir)+t)
+			if err != nil {
+				return errors.Wrap(err, "modFile")
+			}
+			if mod != nil {
+				continue
+			}
+			version += "+incompatible"
+		}
+		// the latest ancestor may be the commit itself.
+		tri, err := g.ch.TagInfo(ctx, m.owner, m.repo, tagPrefix(m.dir)+t)
 		if err != nil {
-			return nil, errors.Wrap(err, "goMod.shaFromPseudo")
+			return errors.Wrap(err, "TagInfo")
 		}
+		if tri.Name == ri.Name {
+			ri.Short = version
+			ri.Version = version
+		} else {
+			ri.Version = PseudoVersion(major, version, ri.Time, ri.Short)
+		}
+		return nil
 	}
 
-	modBts, err := g.ch.GetModFile(ctx, owner, repo, version)
-	if err == ErrNotFound {
+	ri.Version = PseudoVersion(major, "", ri.Time, ri.Short)
+	return nil
+}
+
+func (g *generic) GoMod(ctx context.Context, module string, version string) ([]byte, error) {
+	m, err := g.parseModule(module)
+	if err != nil {
+		return nil, errors.Wrap(err, "goMod.parseModule")
+	}
+	ref, err := gitRef(m.dir, version)
+	if err != nil {
+		return nil, errors.Wrap(err, "goMod.gitRef")
+	}
+
+	_, modBts, err := g.modFile(ctx, m, ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "goMod.modFile")
+	} else if modBts == nil {
 		return []byte(fmt.Sprintf("module %v\n", module)), nil
-	} else if err != nil {
-		return nil, errors.Wrap(err, "goMod.GetModFile")
 	}
 
 	return modBts, nil
 }
 
+// Zip downloads an archive of the repository and rewrites it as a
+// module zip with golang.org/x/mod/zip, so that it follows the same
+// rules as cmd/go: only the module's own directory is kept, nested
+// modules, vendored packages and symlinks are left out, and size
+// limits and case-insensitive file name collisions are errors.
 func (g *generic) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
-	ref := strings.Replace(version, "+incompatible", "", 1)
-	var err error
-	if strings.HasPrefix(version, "v0.0.0-") {
-		ref, err = ShaFromPseudo(version)
-		if err != nil {
-			return nil, errors.Wrap(err, "zip.shaFromPseudo")
-		}
+	m, err := g.parseModule(module)
+	if err != nil {
+		return nil, errors.Wrap(err, "zip.parseModule")
 	}
-	owner, repo, err := SplitPath(module)
+	ref, err := gitRef(m.dir, version)
 	if err != nil {
-		return nil, errors.Wrap(err, "zip.splitPath")
+		return nil, errors.Wrap(err, "zip.gitRef")
 	}
-	u, err := g.ch.TarURL(ctx, owner, repo, ref)
+	dir := m.dir
+	if m.major != "" {
+		if dir, _, err = g.modFile(ctx, m, ref); err != nil {
+			return nil, errors.Wrap(err, "zip.modFile")
+		}
+	}
+	body, format, err := g.archive(ctx, m.owner, m.repo, ref)
 	if err != nil {
-		return nil, errors.Wrap(err, "zip.getURL")
+		return nil, errors.Wrap(err, "zip.archive")
 	}
-
-	resp, err := http.Get(u)
+	e, err := extract(body, format, tagPrefix(dir))
 	if err != nil {
-		return nil, errors.Wrap(err, "zip.httpGet")
+		return nil, errors.Wrap(err, "zip.extract")
 	}
 
-	gr, err := gzip.NewReader(resp.Body)
+	// check the files before anything is written, which
+	// would otherwise fail half way through the response.
+	cf, err := modzip.CheckFiles(e.files)
+	if err == nil {
+		err = cf.Err()
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "zip.gzipNewReader")
+		e.close()
+		return nil, errors.Wrap(err, "zip.checkFiles")
 	}
 
-	t := tar.NewReader(gr)
-	goModName := g.org(module) + "/" + owner + "/" + repo + "@" + version + "/"
+	mv := gomodule.Version{Path: module, Version: version}
 	if zipPrefix != "" {
-		goModName = zipPrefix + "@" + version + "/"
-	}
-	var dirName string
-
-	// grab the first folder/file header to extract the directory name so it can be replaced
-	// with goModName from above. Go expects the tar to have a certain directory prefix.
-	// Github always has a directory header, while bitbucket jumps straight into the file.
-	// This loop accounts for both cases.
-	h, err := t.Next()
-	for {
-		if err != nil {
-			return nil, errors.Wrap(err, "zip.tarNext")
-		}
-		if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeDir {
-			h, err = t.Next()
-			continue
-		}
-		if h.Typeflag == tar.TypeDir {
-			dirName = h.Name
-			h, err = t.Next()
-			break
-		}
-		if h.Typeflag == tar.TypeReg {
-			dirName = filepath.Dir(h.Name) + "/"
-			break
-		}
-		h, err = t.Next()
+		mv.Path = zipPrefix
 	}
-
 	pr, pw := io.Pipe()
+	done := make(chan struct{})
 	go func() {
-		zw := zip.NewWriter(pw)
-		for {
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				zw.Close()
-				pw.CloseWithError(errors.Wrap(err, "zip.tarNext"))
-				return
-			} else if h.Typeflag != tar.TypeReg && h.Typeflag != tar.TypeDir {
-				h, err = t.Next()
-				continue
-			}
-			path := strings.Replace(h.Name, dirName, goModName, 1)
-			var w io.Writer // otherwise we shadow err and we end up calling nil.Next on line 183.
-			w, err = zw.Create(path)
-			if err != nil {
-				zw.Close()
-				pw.CloseWithError(errors.Wrap(err, "zip.zipCreate"))
-				return
-			}
-
-			_, err = io.Copy(w, t)
-			if err != nil {
-				zw.Close()
-				pw.CloseWithError(errors.Wrap(err, "zip.ioCopy"))
-				return
-			}
-			h, err = t.Next()
+		defer e.close()
+		pw.CloseWithError(modzip.Create(pw, mv, e.files))
+		close(done)
+	}()
+	// closing the reader, or a canceled ctx, stops
+	// the writer when the consumer stops reading.
+	go func() {
+		select {
+		case <-ctx.Done():
+			pr.CloseWithError(ctx.Err())
+		case <-done:
 		}
-		zw.Close()
-		pw.Close()
 	}()
 
 	return pr, nil
 }
 
-func (g *generic) org(path string) string {
-	return strings.Split(path, "/")[0]
+// modulePath is where a module lives in its repository.
+type modulePath struct {
+	owner, repo string
+	// dir is the directory of the module path without its major
+	// version suffix, which is also the prefix of its tags.
+	dir string
+	// major is the /vN suffix of the module path, if any.
+	major string
+}
+
+func (g *generic) parseModule(module string) (*modulePath, error) {
+	prefix, major, ok := SplitPathVersion(module)
+	if !ok {
+		return nil, errors.Wrap(ErrInvalidVersion, "invalid major version suffix: "+module)
+	}
+	split := SplitModule
+	if ps, ok := g.ch.(PathSplitter); ok {
+		split = ps.SplitModule
+	}
+	owner, repo, dir, err := split(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &modulePath{owner, repo, dir, major}, nil
+}
+
+// modFile finds the directory holding the module at ref and returns
+// it along with the module's go.mod file, which is nil if there is none.
+// Like cmd/go, a /vN module is looked up in the vN subdirectory first
+// (the major subdirectory layout) and then in the directory of its
+// tags (the major branch layout).
+func (g *generic) modFile(ctx context.Context, m *modulePath, ref string) (string, []byte, error) {
+	if m.major != "" {
+		sub := path.Join(m.dir, m.major[1:])
+		bts, err := g.ch.GetModFile(ctx, m.owner, m.repo, sub, ref)
+		if err == nil {
+			return sub, bts, nil
+		} else if !errors.Is(err, ErrNotFound) {
+			return "", nil, err
+		}
+	}
+	bts, err := g.ch.GetModFile(ctx, m.owner, m.repo, m.dir, ref)
+	if errors.Is(err, ErrNotFound) {
+		return m.dir, nil, nil
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	return m.dir, bts, nil
+}
+
+// tagPrefix returns the prefix of tags, and of archive paths,
+// that belong to the module in dir.
+func tagPrefix(dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	return dir + "/"
+}
+
+// gitRef returns the commit hash of a pseudo-version, or the
+// tag of any other version of the module in dir.
+func gitRef(dir, version string) (string, error) {
+	if !semver.IsValid(version) {
+		return "", errors.Wrapf(ErrInvalidVersion, "%v is not a semantic version", version)
+	}
+	version = strings.Replace(version, "+incompatible", "", 1)
+	if IsPseudo(version) {
+		return ShaFromPseudo(version)
+	}
+
+	return tagPrefix(dir) + version, nil
+}
+
+// archive opens an archive of the repository at ref, either
+// streamed by the CodeHost itself or downloaded from its TarURL.
+func (g *generic) archive(ctx context.Context, owner, repo, ref string) (io.ReadCloser, ArchiveFormat, error) {
+	if a, ok := g.ch.(Archiver); ok {
+		return a.Archive(ctx, owner, repo, ref)
+	}
+
+	u, err := g.ch.TarURL(ctx, owner, repo, ref)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "getURL")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "newRequest")
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, errors.Wrap(Unavailable(err), "httpGet")
+	}
+	if err := CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, 0, errors.Wrap(err, "archive")
+	}
+
+	return resp.Body, ArchiveTarGz, nil
 }
@@ -0,0 +1,286 @@
+package sumdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/checksum"
+	"github.com/pkg/errors"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+	"golang.org/x/mod/sumdb/tlog"
+)
+
+// Private is a checksum database of the modules that gdp serves,
+// for hosts that sum.golang.org can't see. Every version is added
+// to its transparency log the first time it's looked up, which
+// cmd/go does before it downloads it, with the hashes of the zip
+// and go.mod that gdp serves for it then.
+//
+// The log is kept in a directory as a single append-only records
+// file, and its hashes are recomputed from it on startup.
+type Private struct {
+	dp     checksum.Protocol
+	signer note.Signer
+	vkey   string
+	srv    *sumdb.Server
+	path   string
+
+	mu      sync.Mutex
+	records [][]byte
+	lookup  map[string]int64
+	hashes  []tlog.Hash
+}
+
+// NewPrivate opens the checksum database in dir, creating it if
+// needed. skey is a note signer key, as generated by
+// note.GenerateKey, whose name is the name of the database.
+func NewPrivate(dir, skey string, dp checksum.Protocol) (*Private, error) {
+	signer, err := note.NewSigner(skey)
+	if err != nil {
+		return nil, errors.Wrap(err, "sumdb.newSigner")
+	}
+	vkey, err := verifierKey(skey)
+	if err != nil {
+		return nil, errors.Wrap(err, "sumdb.verifierKey")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "sumdb.mkdir")
+	}
+	p := &Private{
+		dp:     dp,
+		signer: signer,
+		vkey:   vkey,
+		path:   filepath.Join(dir, "records"),
+		lookup: map[string]int64{},
+	}
+	p.srv = sumdb.NewServer(p)
+	if err := p.load(); err != nil {
+		return nil, errors.Wrap(err, "sumdb.load")
+	}
+
+	return p, nil
+}
+
+// GenerateKey returns the signer key in dir/key, or
+// generates one for a database called name and saves it.
+func GenerateKey(dir, name string) (string, error) {
+	p := filepath.Join(dir, "key")
+	bts, err := ioutil.ReadFile(p)
+	if err == nil {
+		return strings.TrimSpace(string(bts)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	skey, _, err := note.GenerateKey(rand.Reader, name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	return skey, ioutil.WriteFile(p, []byte(skey+"\n"), 0600)
+}
+
+// Name is the name of the database, which it is served under.
+func (p *Private) Name() string {
+	return p.signer.Name()
+}
+
+// VerifierKey is the key that GOSUMDB should be set to.
+func (p *Private) VerifierKey() string {
+	return p.vkey
+}
+
+// ServeHTTP serves the database under /sumdb/<name>/,
+// just like a GOPROXY that proxies it.
+func (p *Private) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix := "/sumdb/" + p.Name()
+	if !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == prefix+"/supported" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	http.StripPrefix(prefix, p.srv).ServeHTTP(w, r)
+}
+
+// load reads the records file, dropping a record that was only
+// partially written, and recomputes the hashes of the log.
+func (p *Private) load() error {
+	bts, err := ioutil.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// records are separated by an empty line.
+	complete := bytes.LastIndex(bts, []byte("\n\n")) + 2
+	if complete == 1 {
+		complete = 0
+	}
+	if complete != len(bts) {
+		if err := os.Truncate(p.path, int64(complete)); err != nil {
+			return err
+		}
+		bts = bts[:complete]
+	}
+	for _, rec := range bytes.SplitAfter(bts, []byte("\n\n")) {
+		if len(rec) == 0 {
+			continue
+		}
+		if err := p.add(rec[:len(rec)-1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// add appends a record to the log in memory.
+// Its first word is the module and its second
+// the version, just like in go.sum.
+func (p *Private) add(rec []byte) error {
+	fields := strings.Fields(string(rec))
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid record %q", rec)
+	}
+	id := int64(len(p.records))
+	hashes, err := tlog.StoredHashesForRecordHash(id, tlog.RecordHash(rec), hashReader(p.hashes))
+	if err != nil {
+		return err
+	}
+	p.records = append(p.records, rec)
+	p.hashes = append(p.hashes, hashes...)
+	p.lookup[fields[0]+"@"+fields[1]] = id
+
+	return nil
+}
+
+// Signed implements sumdb.ServerOps.
+func (p *Private) Signed(ctx context.Context) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	size := int64(len(p.records))
+	h, err := tlog.TreeHash(size, hashReader(p.hashes))
+	if err != nil {
+		return nil, err
+	}
+	text := tlog.FormatTree(tlog.Tree{N: size, Hash: h})
+
+	return note.Sign(&note.Note{Text: string(text)}, p.signer)
+}
+
+// ReadRecords implements sumdb.ServerOps.
+func (p *Private) ReadRecords(ctx context.Context, id, n int64) ([][]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id < 0 || id+n > int64(len(p.records)) {
+		return nil, os.ErrNotExist
+	}
+
+	return p.records[id : id+n], nil
+}
+
+// Lookup implements sumdb.ServerOps, adding a record
+// for m if the log doesn't have one yet.
+func (p *Private) Lookup(ctx context.Context, m module.Version) (int64, error) {
+	// unlike semver.Canonical, CanonicalVersion keeps +incompatible.
+	if module.CanonicalVersion(m.Version) != m.Version {
+		return 0, os.ErrNotExist
+	}
+	key := m.String()
+	p.mu.Lock()
+	id, ok := p.lookup[key]
+	p.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	sums, err := p.dp.Sum(ctx, m.Path, m.Version)
+	if errors.Is(err, gdp.ErrNotFound) || errors.Is(err, gdp.ErrGone) {
+		return 0, os.ErrNotExist
+	} else if err != nil {
+		return 0, err
+	}
+	rec := []byte(sums.GoSum(m.Path, m.Version))
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// another lookup may have added it in the meantime.
+	if id, ok := p.lookup[key]; ok {
+		return id, nil
+	}
+	f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Write(append(rec, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := p.add(rec); err != nil {
+		return 0, err
+	}
+
+	return p.lookup[key], nil
+}
+
+// ReadTileData implements sumdb.ServerOps.
+func (p *Private) ReadTileData(ctx context.Context, t tlog.Tile) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return tlog.ReadTileData(t, hashReader(p.hashes))
+}
+
+type hashReader []tlog.Hash
+
+func (h hashReader) ReadHashes(indexes []int64) ([]tlog.Hash, error) {
+	list := make([]tlog.Hash, 0, len(indexes))
+	for _, id := range indexes {
+		if id < 0 || id >= int64(len(h)) {
+			return nil, os.ErrNotExist
+		}
+		list = append(list, h[id])
+	}
+
+	return list, nil
+}
+
+// verifierKey returns the verifier key of an ed25519 signer
+// key, which is PRIVATE+KEY+<name>+<hash>+<key>.
+func verifierKey(skey string) (string, error) {
+	els := strings.SplitN(skey, "+", 5)
+	if len(els) != 5 {
+		return "", fmt.Errorf("malformed signer key")
+	}
+	key, err := base64.StdEncoding.DecodeString(els[4])
+	if err != nil || len(key) != 1+ed25519.SeedSize || key[0] != 1 {
+		return "", fmt.Errorf("malformed signer key")
+	}
+	pub := ed25519.NewKeyFromSeed(key[1:]).Public().(ed25519.PublicKey)
+
+	return note.NewEd25519VerifierKey(els[2], pub)
+}
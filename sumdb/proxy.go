@@ -0,0 +1,126 @@
+// Package sumdb proxies checksum databases such as sum.golang.org
+// through a GOPROXY, for when cmd/go can't reach them directly.
+package sumdb
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/marwan-at-work/gdp/internal/lru"
+)
+
+// Option configures the handler returned by NewProxy.
+type Option func(*proxy)
+
+// WithHTTPClient makes the requests to the upstream
+// databases with c instead of http.DefaultClient.
+func WithHTTPClient(c *http.Client) Option {
+	return func(p *proxy) {
+		p.hc = c
+	}
+}
+
+// WithCacheLimit caps how many tile and lookup responses the
+// proxy keeps in memory, 16384 by default. The responses served
+// least recently are dropped first.
+func WithCacheLimit(n int) Option {
+	return func(p *proxy) {
+		p.limit = n
+	}
+}
+
+// NewProxy returns a handler for /sumdb/<name>/ requests that forwards
+// them to upstreams[name], the base url of a checksum database such as
+// https://sum.golang.org. Databases that aren't in upstreams answer
+// 404 on /supported, which tells cmd/go to contact them directly;
+// a nil map disables the proxy.
+//
+// Tiles and lookups never change once served, so they are cached,
+// while /latest is always forwarded.
+func NewProxy(upstreams map[string]string, opts ...Option) http.Handler {
+	p := &proxy{
+		upstreams: map[string]string{},
+		hc:        http.DefaultClient,
+		limit:     16384,
+	}
+	for name, u := range upstreams {
+		p.upstreams[name] = strings.TrimSuffix(u, "/")
+	}
+	for _, o := range opts {
+		o(p)
+	}
+	p.cache = lru.New(p.limit)
+
+	return p
+}
+
+type proxy struct {
+	upstreams map[string]string
+	hc        *http.Client
+	limit     int
+	cache     *lru.Cache
+}
+
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /sumdb/<name>/<path>
+	els := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/sumdb/"), "/", 2)
+	if len(els) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	upstream, ok := p.upstreams[els[0]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	path := "/" + els[1]
+	switch {
+	case path == "/supported":
+		w.WriteHeader(http.StatusOK)
+		return
+	case path == "/latest":
+	case strings.HasPrefix(path, "/lookup/"), strings.HasPrefix(path, "/tile/"):
+		if bts, ok := p.cache.Get(r.URL.Path); ok {
+			w.Write(bts)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, upstream+path, nil)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resp, err := p.hc.Do(req.WithContext(r.Context()))
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		// cmd/go tells a missing module apart from a failing database.
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	default:
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	bts, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if path != "/latest" {
+		p.cache.Add(r.URL.Path, bts)
+	}
+
+	w.Write(bts)
+}
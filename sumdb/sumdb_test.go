@@ -0,0 +1,220 @@
+package sumdb
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/checksum"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/note"
+)
+
+func TestProxy(t *testing.T) {
+	signer, key, err := note.GenerateKey(rand.Reader, "sum.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := sumdb.NewTestServer(signer, func(path, vers string) ([]byte, error) {
+		if path != "example.com/mod" {
+			return nil, fmt.Errorf("no such module")
+		}
+		return []byte(fmt.Sprintf("%v %v h1:zip\n%v %v/go.mod h1:mod\n", path, vers, path, vers)), nil
+	})
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		sumdb.NewServer(db).ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+	srv := httptest.NewServer(NewProxy(map[string]string{"sum.example.com": upstream.URL}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sumdb/sum.example.com/supported")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the database to be supported: %v", err)
+	}
+	resp, err = http.Get(srv.URL + "/sumdb/sum.golang.org/supported")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected sum.golang.org not to be supported: %v", err)
+	}
+
+	// a sumdb client through the proxy verifies
+	// the lookups and tiles it gets from it.
+	client := sumdb.NewClient(&clientOps{key: key, url: srv.URL + "/sumdb/sum.example.com"})
+	for _, vers := range []string{"v1.0.0", "v1.1.0", "v1.0.0"} {
+		lines, err := client.Lookup("example.com/mod", vers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != 1 || lines[0] != "example.com/mod "+vers+" h1:zip" {
+			t.Fatalf("unexpected lines %v", lines)
+		}
+	}
+	n := atomic.LoadInt32(&requests)
+	if _, err := (&clientOps{url: srv.URL + "/sumdb/sum.example.com"}).ReadRemote("/lookup/example.com/mod@v1.0.0"); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&requests) != n {
+		t.Fatal("expected the lookup to be cached")
+	}
+
+	if _, err := client.Lookup("example.com/other", "v1.0.0"); err == nil {
+		t.Fatal("expected an error for a missing module")
+	}
+
+	disabled := httptest.NewServer(NewProxy(nil))
+	defer disabled.Close()
+	resp, err = http.Get(disabled.URL + "/sumdb/sum.example.com/supported")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a disabled proxy to answer 404: %v", err)
+	}
+}
+
+// clientOps is a sumdb.ClientOps that keeps
+// everything in memory and reads from url.
+type clientOps struct {
+	key, url string
+	latest   []byte
+}
+
+func (c *clientOps) ReadRemote(path string) ([]byte, error) {
+	resp, err := http.Get(c.url + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %v: %v", path, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *clientOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(c.key), nil
+	}
+
+	return c.latest, nil
+}
+
+func (c *clientOps) WriteConfig(file string, old, new []byte) error {
+	c.latest = new
+	return nil
+}
+
+func (c *clientOps) ReadCache(file string) ([]byte, error) { return nil, fmt.Errorf("no cache") }
+func (c *clientOps) WriteCache(file string, data []byte)   {}
+func (c *clientOps) Log(msg string)                        {}
+func (c *clientOps) SecurityError(msg string)              { panic(msg) }
+
+// fakeProtocol serves every version below
+// v2, or +incompatible, with the same file in it.
+type fakeProtocol struct {
+	gdp.DownloadProtocol
+	content string
+}
+
+func (f *fakeProtocol) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	if version >= "v2" && !strings.HasSuffix(version, "+incompatible") {
+		return nil, gdp.ErrNotFound
+	}
+
+	return []byte("module " + module + "\n"), nil
+}
+
+func (f *fakeProtocol) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create(module + "@" + version + "/mod.go")
+	w.Write([]byte(f.content))
+	zw.Close()
+
+	return &buf, nil
+}
+
+func TestPrivate(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "sumdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	skey, err := GenerateKey(dir, "sum.mycorp.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := GenerateKey(dir, "sum.mycorp.com"); err != nil || again != skey {
+		t.Fatalf("expected the saved key: %v", err)
+	}
+
+	dp := checksum.New(&fakeProtocol{content: "package mod\n"})
+	p, err := NewPrivate(filepath.Join(dir, "db"), skey, dp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	ops := &clientOps{key: p.VerifierKey(), url: srv.URL + "/sumdb/sum.mycorp.com"}
+	client := sumdb.NewClient(ops)
+	sums := map[string]string{}
+	for _, vers := range []string{"v1.0.0", "v1.1.0", "v3.0.0+incompatible"} {
+		lines, err := client.Lookup("git.mycorp.com/owner/repo", vers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := dp.Sum(ctx, "git.mycorp.com/owner/repo", vers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != 1 || lines[0] != "git.mycorp.com/owner/repo "+vers+" "+s.Zip {
+			t.Fatalf("unexpected lines %v", lines)
+		}
+		sums[vers] = lines[0]
+	}
+	if _, err := client.Lookup("git.mycorp.com/owner/repo", "v2.0.0"); err == nil {
+		t.Fatal("expected an error for a missing version")
+	}
+
+	// reopen the database after a crash half way through a record, with
+	// a code host that now serves something else: the log keeps what it
+	// first served, and stays consistent with what clients have seen.
+	f, err := os.OpenFile(filepath.Join(dir, "db", "records"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("git.mycorp.com/owner/repo v1.2.0 h1:")
+	f.Close()
+	p, err = NewPrivate(filepath.Join(dir, "db"), skey, checksum.New(&fakeProtocol{content: "package changed\n"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Config.Handler = p
+	client = sumdb.NewClient(ops)
+	for _, vers := range []string{"v1.0.0", "v1.1.0", "v1.2.0"} {
+		lines, err := client.Lookup("git.mycorp.com/owner/repo", vers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != 1 || strings.Count(lines[0], " ") != 2 {
+			t.Fatalf("unexpected lines %v", lines)
+		}
+		if sum, ok := sums[vers]; ok && lines[0] != sum {
+			t.Fatalf("expected %v but got %v", sum, lines[0])
+		}
+	}
+}
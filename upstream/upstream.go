@@ -0,0 +1,377 @@
+// Package upstream fetches modules from other GOPROXY servers, such
+// as proxy.golang.org or Athens, instead of redirecting clients to
+// them, so that what they serve can be cached like any other module
+// and clients that can't reach them still get their modules.
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/internal/autoclose"
+	"github.com/pkg/errors"
+	gomodule "golang.org/x/mod/module"
+)
+
+// Option configures the DownloadProtocol returned by New.
+type Option func(*chain)
+
+// WithHTTPClient fetches from the upstream proxies with c
+// instead of a client that gives up after 10 minutes.
+func WithHTTPClient(c *http.Client) Option {
+	return func(ch *chain) {
+		ch.c = c
+	}
+}
+
+// New returns a DownloadProtocol that goes through the proxies of
+// list in order, as cmd/go does with GOPROXY. The proxies are urls,
+// https if they have no scheme, with optional user:password@ basic
+// auth credentials. "direct" stands for direct, such as the code
+// hosts of download.New, and "off" fails every request with
+// gdp.ErrNotFound, so that nothing after it is tried.
+//
+// A proxy followed by a comma falls through to the next one only
+// when it doesn't have the module or version, as with a 404 or 410,
+// while one followed by a pipe falls through on any error.
+func New(list string, direct gdp.DownloadProtocol, opts ...Option) (gdp.DownloadProtocol, error) {
+	c := &chain{c: &http.Client{Timeout: 10 * time.Minute}}
+	for _, o := range opts {
+		o(c)
+	}
+
+	for list != "" {
+		var el string
+		var fallBackOnError bool
+		if i := strings.IndexAny(list, ",|"); i >= 0 {
+			el, fallBackOnError, list = list[:i], list[i] == '|', list[i+1:]
+		} else {
+			el, list = list, ""
+		}
+		el = strings.TrimSpace(el)
+		if el == "" {
+			continue
+		}
+
+		switch el {
+		case "off":
+			// off always fails, so the rest is never tried.
+			c.proxies = append(c.proxies, proxySpec{name: el, dp: off{}})
+			list = ""
+		case "direct":
+			if direct == nil {
+				return nil, errors.New("upstream.New: direct is not available")
+			}
+			c.proxies = append(c.proxies, proxySpec{name: el, dp: direct, direct: true, fallBackOnError: fallBackOnError})
+		default:
+			p, err := newProxy(el, c.c)
+			if err != nil {
+				return nil, errors.Wrap(err, "upstream.New")
+			}
+			c.proxies = append(c.proxies, proxySpec{name: p.url, dp: p, fallBackOnError: fallBackOnError})
+		}
+	}
+	if len(c.proxies) == 0 {
+		return nil, errors.New("upstream.New: empty proxy list")
+	}
+
+	return c, nil
+}
+
+type chain struct {
+	proxies []proxySpec
+	c       *http.Client
+}
+
+type proxySpec struct {
+	name            string
+	dp              gdp.DownloadProtocol
+	direct          bool
+	fallBackOnError bool
+}
+
+// The ranks of the errors of the proxies that were tried. Like cmd/go,
+// the error of direct is the most helpful one, followed by those of
+// proxies other than a missing module, followed by a missing module.
+const (
+	notExistRank = iota
+	proxyRank
+	directRank
+)
+
+// try calls fn with the proxies in order until one succeeds,
+// or else returns the most helpful of their errors.
+func (c *chain) try(ctx context.Context, fn func(gdp.DownloadProtocol) error) error {
+	var bestErr error
+	bestErrRank := notExistRank
+	for _, p := range c.proxies {
+		err := fn(p.dp)
+		if err == nil {
+			return nil
+		}
+		err = errors.Wrap(err, p.name)
+		isNotExist := errors.Is(err, gdp.ErrNotFound) || errors.Is(err, gdp.ErrGone)
+		switch {
+		case p.direct:
+			bestErr, bestErrRank = err, directRank
+		case bestErrRank <= proxyRank && !isNotExist:
+			bestErr, bestErrRank = err, proxyRank
+		case bestErrRank == notExistRank:
+			bestErr = err
+		}
+		if !p.fallBackOnError && !isNotExist || ctx.Err() != nil {
+			break
+		}
+	}
+
+	return bestErr
+}
+
+func (c *chain) List(ctx context.Context, module string) ([]string, error) {
+	var vers []string
+	err := c.try(ctx, func(dp gdp.DownloadProtocol) (err error) {
+		vers, err = dp.List(ctx, module)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "upstream.List")
+	}
+
+	return vers, nil
+}
+
+func (c *chain) Info(ctx context.Context, module, version string) (*gdp.RevInfo, error) {
+	var info *gdp.RevInfo
+	err := c.try(ctx, func(dp gdp.DownloadProtocol) (err error) {
+		info, err = dp.Info(ctx, module, version)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "upstream.Info")
+	}
+
+	return info, nil
+}
+
+func (c *chain) Latest(ctx context.Context, module string) (*gdp.RevInfo, error) {
+	var info *gdp.RevInfo
+	err := c.try(ctx, func(dp gdp.DownloadProtocol) (err error) {
+		info, err = dp.Latest(ctx, module)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "upstream.Latest")
+	}
+
+	return info, nil
+}
+
+func (c *chain) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	var bts []byte
+	err := c.try(ctx, func(dp gdp.DownloadProtocol) (err error) {
+		bts, err = dp.GoMod(ctx, module, version)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "upstream.GoMod")
+	}
+
+	return bts, nil
+}
+
+func (c *chain) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
+	var rdr io.Reader
+	err := c.try(ctx, func(dp gdp.DownloadProtocol) (err error) {
+		rdr, err = dp.Zip(ctx, module, version, zipPrefix)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "upstream.Zip")
+	}
+
+	return rdr, nil
+}
+
+// proxy is a DownloadProtocol client of a GOPROXY at url.
+type proxy struct {
+	url  string
+	user *url.Userinfo
+	c    *http.Client
+}
+
+func newProxy(rawurl string, c *http.Client) (*proxy, error) {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "https://" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+		return nil, errors.Errorf("invalid proxy url %q", u.Redacted())
+	}
+
+	// credentials are sent as basic auth,
+	// to keep them out of urls and errors.
+	user := u.User
+	u.User = nil
+
+	return &proxy{url: strings.TrimSuffix(u.String(), "/"), user: user, c: c}, nil
+}
+
+func (p *proxy) List(ctx context.Context, module string) ([]string, error) {
+	bts, err := p.get(ctx, module, "/@v/list")
+	if err != nil {
+		return nil, err
+	}
+
+	// like cmd/go, only the first field of a line is a version.
+	vers := []string{}
+	for _, line := range strings.Split(string(bts), "\n") {
+		if f := strings.Fields(line); len(f) > 0 {
+			vers = append(vers, f[0])
+		}
+	}
+
+	return vers, nil
+}
+
+func (p *proxy) Info(ctx context.Context, module, version string) (*gdp.RevInfo, error) {
+	file, err := versionFile(version, ".info")
+	if err != nil {
+		return nil, err
+	}
+	bts, err := p.get(ctx, module, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return revInfo(bts)
+}
+
+func (p *proxy) Latest(ctx context.Context, module string) (*gdp.RevInfo, error) {
+	bts, err := p.get(ctx, module, "/@latest")
+	if err != nil {
+		return nil, err
+	}
+
+	return revInfo(bts)
+}
+
+func (p *proxy) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	file, err := versionFile(version, ".mod")
+	if err != nil {
+		return nil, err
+	}
+
+	return p.get(ctx, module, file)
+}
+
+// Zip streams the zip of the proxy, whose files are under
+// module@version/, so it can't serve them under another zipPrefix.
+func (p *proxy) Zip(ctx context.Context, module, version, zipPrefix string) (io.Reader, error) {
+	if zipPrefix != "" && zipPrefix != module {
+		return nil, errors.Errorf("zip of %v can't be served as %v", module, zipPrefix)
+	}
+	file, err := versionFile(version, ".zip")
+	if err != nil {
+		return nil, err
+	}
+	rc, err := p.open(ctx, module, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return autoclose.New(rc, rc.Close), nil
+}
+
+func (p *proxy) get(ctx context.Context, module, file string) ([]byte, error) {
+	rc, err := p.open(ctx, module, file)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	bts, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, gdp.Unavailable(err)
+	}
+
+	return bts, nil
+}
+
+func (p *proxy) open(ctx context.Context, module, file string) (io.ReadCloser, error) {
+	path, err := gomodule.EscapePath(module)
+	if err != nil {
+		return nil, errors.Wrap(gdp.ErrNotFound, err.Error())
+	}
+	req, err := http.NewRequest(http.MethodGet, p.url+"/"+path+file, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.user != nil {
+		pw, _ := p.user.Password()
+		req.SetBasicAuth(p.user.Username(), pw)
+	}
+	resp, err := p.c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, gdp.Unavailable(err)
+	}
+	if err := gdp.CheckResponse(resp); err != nil {
+		resp.Body.Close()
+		return nil, errors.Wrap(err, module+file)
+	}
+
+	return resp.Body, nil
+}
+
+// versionFile returns the path of a file of
+// version under /@v/, such as /@v/v1.0.0.mod.
+func versionFile(version, ext string) (string, error) {
+	v, err := gomodule.EscapeVersion(version)
+	if err != nil {
+		return "", errors.Wrap(gdp.ErrInvalidVersion, err.Error())
+	}
+
+	return "/@v/" + v + ext, nil
+}
+
+func revInfo(bts []byte) (*gdp.RevInfo, error) {
+	var info gdp.RevInfo
+	if err := json.Unmarshal(bts, &info); err != nil {
+		return nil, errors.Wrap(err, "revInfo")
+	}
+
+	return &info, nil
+}
+
+// off is the "off" proxy, which disallows looking modules up.
+type off struct{}
+
+var errOff = errors.Wrap(gdp.ErrNotFound, "module lookup disabled by GOPROXY=off")
+
+func (off) List(context.Context, string) ([]string, error) {
+	return nil, errOff
+}
+
+func (off) Info(context.Context, string, string) (*gdp.RevInfo, error) {
+	return nil, errOff
+}
+
+func (off) Latest(context.Context, string) (*gdp.RevInfo, error) {
+	return nil, errOff
+}
+
+func (off) GoMod(context.Context, string, string) ([]byte, error) {
+	return nil, errOff
+}
+
+func (off) Zip(context.Context, string, string, string) (io.Reader, error) {
+	return nil, errOff
+}
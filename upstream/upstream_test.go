@@ -0,0 +1,210 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/internal/autoclose"
+	"github.com/pkg/errors"
+)
+
+const module = "golang.org/x/text"
+
+var ctx = context.Background()
+
+// fakeProxy serves v0.3.0 of module like a GOPROXY would,
+// with a list line that carries more than the version.
+func fakeProxy(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch p := r.URL.Path; p {
+		case "/" + module + "/@v/list":
+			fmt.Fprint(w, "v0.1.0\nv0.3.0 2017-12-14T13:08:43Z\n")
+		case "/" + module + "/@v/v0.3.0.info", "/" + module + "/@latest":
+			fmt.Fprint(w, `{"Version": "v0.3.0", "Time": "2017-12-14T13:08:43Z"}`)
+		case "/" + module + "/@v/v0.3.0.mod":
+			fmt.Fprint(w, "module "+module+"\n")
+		case "/" + module + "/@v/v0.3.0.zip":
+			fmt.Fprint(w, "zip of "+module)
+		default:
+			t.Logf("unexpected path %v", p)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// statusProxy answers every request with code.
+func statusProxy(code int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+}
+
+// direct is a DownloadProtocol of the code hosts that fails with err.
+type direct struct {
+	gdp.DownloadProtocol
+	err error
+}
+
+func (d direct) GoMod(ctx context.Context, module, version string) ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return []byte("module " + module + " // direct\n"), nil
+}
+
+func TestProxy(t *testing.T) {
+	srv := fakeProxy(t)
+	defer srv.Close()
+	dp, err := New(srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vers, err := dp.List(ctx, module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vers, []string{"v0.1.0", "v0.3.0"}) {
+		t.Fatalf("unexpected list versions %v", vers)
+	}
+
+	info, err := dp.Info(ctx, module, "v0.3.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &gdp.RevInfo{Version: "v0.3.0", Time: time.Date(2017, 12, 14, 13, 8, 43, 0, time.UTC)}
+	if !reflect.DeepEqual(info, expected) {
+		t.Fatalf("unexpected rev info %#v", info)
+	}
+	if info, err = dp.Latest(ctx, module); err != nil || info.Version != "v0.3.0" {
+		t.Fatalf("unexpected latest %v: %v", info, err)
+	}
+
+	rdr, err := dp.Zip(ctx, module, "v0.3.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bts, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bts) != "zip of "+module {
+		t.Fatalf("unexpected zip %s", bts)
+	}
+	rdr, err = dp.Zip(ctx, module, "v0.3.0", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gdp.CloseReader(rdr); err != nil || !rdr.(*autoclose.Reader).Closed() {
+		t.Fatalf("expected the zip to be closed: %v", err)
+	}
+
+	_, err = dp.GoMod(ctx, module, "v0.4.0")
+	if !errors.Is(err, gdp.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound but got %v", err)
+	}
+}
+
+func TestFallBack(t *testing.T) {
+	srv := fakeProxy(t)
+	defer srv.Close()
+	notFound := statusProxy(http.StatusNotFound)
+	defer notFound.Close()
+	broken := statusProxy(http.StatusInternalServerError)
+	defer broken.Close()
+
+	for _, tc := range []struct {
+		list   string
+		direct error
+		mod    string
+		err    error
+	}{
+		// a comma falls through on a missing module only.
+		{list: notFound.URL + "," + srv.URL, mod: "module " + module + "\n"},
+		{list: broken.URL + "," + srv.URL, err: gdp.ErrUnavailable},
+		// a pipe falls through on any error.
+		{list: broken.URL + "|" + srv.URL, mod: "module " + module + "\n"},
+		{list: notFound.URL + ",direct", mod: "module " + module + " // direct\n"},
+		// the error of direct is the most helpful.
+		{list: broken.URL + "|direct", direct: gdp.ErrUnauthorized, err: gdp.ErrUnauthorized},
+		// and a missing module the least.
+		{list: broken.URL + "|" + notFound.URL, err: gdp.ErrUnavailable},
+		{list: notFound.URL + ",off," + srv.URL, err: gdp.ErrNotFound},
+	} {
+		dp, err := New(tc.list, direct{err: tc.direct})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bts, err := dp.GoMod(ctx, module, "v0.3.0")
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("%v: expected %v but got %v", tc.list, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", tc.list, err)
+		}
+		if string(bts) != tc.mod {
+			t.Fatalf("%v: unexpected mod file %s", tc.list, bts)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, list := range []string{"", " , ", "direct", "ftp://proxy.mycorp.com", "https://"} {
+		if _, err := New(list, nil); err == nil {
+			t.Fatalf("expected an error for %q", list)
+		}
+	}
+
+	dp, err := New("proxy.golang.org, direct|off", direct{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range dp.(*chain).proxies {
+		names = append(names, p.name)
+	}
+	if !reflect.DeepEqual(names, []string{"https://proxy.golang.org", "direct", "off"}) {
+		t.Fatalf("unexpected proxies %v", names)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pw, ok := r.BasicAuth(); !ok || user != "jdoe" || pw != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "v0.3.0\n")
+	}))
+	defer srv.Close()
+
+	u := strings.Replace(srv.URL, "://", "://jdoe:secret@", 1)
+	dp, err := New(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dp.List(ctx, module); err != nil {
+		t.Fatal(err)
+	}
+
+	dp, err = New(strings.Replace(srv.URL, "://", "://jdoe:wrong@", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dp.List(ctx, module)
+	if !errors.Is(err, gdp.ErrUnauthorized) || strings.Contains(err.Error(), "wrong") {
+		t.Fatalf("expected ErrUnauthorized without the password but got %v", err)
+	}
+}
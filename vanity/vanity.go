@@ -8,42 +8,61 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/marwan-at-work/gdp"
+	"github.com/marwan-at-work/gdp/gitsmart"
 	"github.com/pkg/errors"
 )
 
-// New returns a vanity deducer.
-func New(gh, bb gdp.DownloadProtocol) gdp.DownloadProtocol {
+// Router returns the DownloadProtocol that serves a repository
+// path, such as github.com/owner/repo, and false if it has none.
+// download.Router implements it.
+type Router interface {
+	Match(path string) (gdp.DownloadProtocol, bool)
+}
+
+// New returns a vanity deducer. r routes the repositories
+// that go-import meta tags point at, such as those on github.com
+// or a self-hosted gitea.mycorp.com, to their DownloadProtocol.
+func New(r Router) gdp.DownloadProtocol {
 	return &protocol{
-		github:    gh,
-		bitbucket: bb,
-		nop:       gdp.NoOpProtocol(),
+		router: r,
+		nop:    gdp.NoOpProtocol(),
+		git:    map[string]gdp.DownloadProtocol{},
 	}
 }
 
 type redir struct {
-	vcs  string
-	base string
-	path string
+	vcs    string
+	base   string
+	path   string
+	scheme string
+	host   string // with its port, if any
 }
 
 func deduceVanity(path string) (redir, error) {
-	var r redir
 	u, err := url.Parse(path)
 	if err != nil {
-		return r, err
+		return redir{}, err
 	}
 	u.Scheme = "http"
 	u.RawQuery = "go-get=1"
 
 	resp, err := http.Get(u.String())
 	if err != nil {
-		return r, err
+		return redir{}, gdp.Unavailable(err)
 	}
 	defer resp.Body.Close()
-	document, err := goquery.NewDocumentFromReader(resp.Body)
+
+	return goImport(path, resp.Body)
+}
+
+// goImport reads the go-import meta tag of path out of an html page.
+func goImport(path string, page io.Reader) (redir, error) {
+	var r redir
+	document, err := goquery.NewDocumentFromReader(page)
 	if err != nil {
 		return r, err
 	}
@@ -66,19 +85,24 @@ func deduceVanity(path string) (redir, error) {
 			return
 		}
 		r.path = u.Hostname() + u.Path
+		r.scheme = u.Scheme
+		r.host = u.Host
 	})
 
+	// without a go-import meta tag of its own, path is no module.
 	if r.base != path {
-		return r, fmt.Errorf("%v != %v", r.base, path)
+		return r, errors.Wrapf(gdp.ErrNotFound, "%v != %v", r.base, path)
 	}
 
 	return r, nil
 }
 
 type protocol struct {
-	github    gdp.DownloadProtocol
-	bitbucket gdp.DownloadProtocol
-	nop       gdp.DownloadProtocol
+	router Router
+	nop    gdp.DownloadProtocol
+
+	mu  sync.Mutex
+	git map[string]gdp.DownloadProtocol // by scheme://host
 }
 
 func (p *protocol) List(ctx context.Context, module string) ([]string, error) {
@@ -91,11 +115,22 @@ func (p *protocol) List(ctx context.Context, module string) ([]string, error) {
 }
 
 func (p *protocol) deduce(r redir) gdp.DownloadProtocol {
-	switch {
-	case strings.HasPrefix(r.path, "github.com"):
-		return p.github
-	case strings.HasPrefix(r.path, "bitbucket.org"):
-		return p.bitbucket
+	if dp, ok := p.router.Match(r.path); ok {
+		return dp
+	}
+
+	// any other git server is spoken to directly over smart HTTP,
+	// with one client per host so it can keep what it learns.
+	if r.vcs == "git" && (r.scheme == "https" || r.scheme == "http") {
+		base := r.scheme + "://" + r.host
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		dp, ok := p.git[base]
+		if !ok {
+			dp = gdp.New(gitsmart.New(base))
+			p.git[base] = dp
+		}
+		return dp
 	}
 
 	return p.nop
@@ -1,6 +1,15 @@
 package vanity
 
-import "testing"
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/marwan-at-work/gdp"
+	"github.com/pkg/errors"
+)
 
 func TestDeduceVanity(t *testing.T) {
 	str, err := deduceVanity("go.opencensus.io")
@@ -10,3 +19,60 @@ func TestDeduceVanity(t *testing.T) {
 
 	t.Fatal(str)
 }
+
+func TestDeduce(t *testing.T) {
+	gh := gdp.New(nil)
+	gt := gdp.New(nil)
+	p := New(routes{
+		"github.com":       gh,
+		"gitea.mycorp.com": gt,
+	}).(*protocol)
+
+	if p.deduce(redir{vcs: "git", path: "gitea.mycorp.com/owner/repo"}) != gt {
+		t.Fatal("expected gitea.mycorp.com to route to its protocol")
+	}
+	if p.deduce(redir{vcs: "hg", path: "unknown.com/owner/repo", scheme: "https"}) != p.nop {
+		t.Fatal("expected an unknown mercurial host to route to the no-op protocol")
+	}
+	dp := p.deduce(redir{vcs: "git", path: "unknown.com/owner/repo", scheme: "https", host: "unknown.com"})
+	if dp == p.nop {
+		t.Fatal("expected an unknown git host to be served over smart HTTP")
+	}
+	if p.deduce(redir{vcs: "git", path: "unknown.com/owner/other", scheme: "https", host: "unknown.com"}) != dp {
+		t.Fatal("expected repositories of a git host to share its client")
+	}
+}
+
+func TestGitPort(t *testing.T) {
+	var hits int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/owner/repo") {
+			hits++
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	page := `<meta name="go-import" content="example.com/repo git ` + srv.URL + `/owner/repo">`
+	r, err := goImport("example.com/repo", strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the repository is fetched from the port of its url.
+	p := New(routes{}).(*protocol)
+	if _, err := p.deduce(r).List(context.Background(), r.path); !errors.Is(err, gdp.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound from the git server but got %v", err)
+	}
+	if hits == 0 {
+		t.Fatal("expected the git server to be asked for the repository")
+	}
+}
+
+// routes is a Router of hosts.
+type routes map[string]gdp.DownloadProtocol
+
+func (r routes) Match(path string) (gdp.DownloadProtocol, bool) {
+	dp, ok := r[strings.Split(path, "/")[0]]
+	return dp, ok
+}